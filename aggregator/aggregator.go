@@ -1,92 +1,523 @@
 package aggregator
 
 import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
 	provisioningv1alpha1 "github.com/itspeetah/neptune-depdag-controller/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/klog/v2"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+// How long publishers have to report that a cycle timed out
+const timeoutReportDeadline = 5 * time.Second
+
 type DependencyGraph = provisioningv1alpha1.DependencyGraph
 type FunctionNode = provisioningv1alpha1.FunctionNode
 
 type Aggregator struct {
-	client client.Client
-	nodes  []FunctionNode
+	client     client.Client
+	metrics    MetricsSource
+	publishers []Publisher
+	graph      types.NamespacedName
+
+	// The spec can be swapped while the aggregator is running, see Update
+	lock  sync.RWMutex
+	nodes []FunctionNode
+	// Namespace where each function runs, indexed by function name
+	namespaces map[string]string
+	// Legacy behaviour where edges with the same id are aggregated together even when invoked by different nodes
+	graphScopedEdgeGroups bool
+	// quantile of the response times the graph is aggregated at, 0 to aggregate averages
+	quantile  float64
+	smoothing provisioningv1alpha1.Smoothing
+	// Smoothing state of each function, kept across cycles and updates
+	smoothers map[string]smoother
+}
+
+func NewAggregator(dag *DependencyGraph, client client.Client, metrics MetricsSource, publishers ...Publisher) *Aggregator {
+	a := &Aggregator{
+		client:     client,
+		metrics:    metrics,
+		publishers: publishers,
+		graph:      types.NamespacedName{Namespace: dag.Namespace, Name: dag.Name},
+	}
+	a.Update(dag)
+	return a
+}
+
+// Update replaces the graph the aggregator computes the times of, keeping the rest of its state.
+// The change applies from the next aggregation cycle.
+func (a *Aggregator) Update(dag *DependencyGraph) {
+	dag = dag.DeepCopy()
+	namespaces := make(map[string]string, len(dag.Spec.Nodes))
+	for _, node := range dag.Spec.Nodes {
+		namespaces[node.FunctionName] = dag.NodeNamespace(node)
+	}
+
+	smoothing := normalizeSmoothing(dag.Spec.Smoothing)
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.nodes = sortNodesByDependencies(dag.Spec.Nodes)
+	a.namespaces = namespaces
+	a.graphScopedEdgeGroups = dag.Annotations[provisioningv1alpha1.EdgeGroupScopeAnnotation] == provisioningv1alpha1.EdgeGroupScopeGraph
+	a.quantile = float64(dag.Spec.Percentile) / 100
+
+	// The state of the functions still in the graph is kept, unless it was collected with a different smoothing
+	if a.smoothers == nil || a.smoothing != smoothing {
+		a.smoothers = make(map[string]smoother)
+	}
+	for function := range a.smoothers {
+		if _, ok := namespaces[function]; !ok {
+			delete(a.smoothers, function)
+		}
+	}
+	a.smoothing = smoothing
 }
 
-func NewAggregator(dag *DependencyGraph, client client.Client) *Aggregator {
-	return &Aggregator{
-		client: client,
-		nodes:  sortNodesByDependencies(dag.Spec.Nodes), // TODO: Maybe deepcopy?
+// smooth records the measured response times and returns the smoothed ones.
+// Functions that were not measured in this cycle keep their smoothed value, if they have one.
+func (a *Aggregator) smooth(responseTimes map[string]float64) map[string]float64 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	smoothed := make(map[string]float64, len(responseTimes))
+	for _, node := range a.nodes {
+		s, ok := a.smoothers[node.FunctionName]
+		if !ok {
+			s = newSmoother(a.smoothing)
+			if s == nil {
+				// No smoothing
+				return responseTimes
+			}
+			a.smoothers[node.FunctionName] = s
+		}
+		if responseTime, measured := responseTimes[node.FunctionName]; measured {
+			smoothed[node.FunctionName] = s.Add(responseTime)
+		} else if value, ok := s.Value(); ok {
+			smoothed[node.FunctionName] = value
+		}
 	}
+	return smoothed
 }
 
-func (a *Aggregator) Aggregate() {
+// Aggregate runs an aggregation cycle, which ends early when the context is done.
+// A canceled cycle publishes nothing, while one past its deadline reports that it timed out.
+func (a *Aggregator) Aggregate(ctx context.Context) {
 
 	klog.Info("Aggregating graph times")
 
-	// Phase 1: get average pod response time for each function in the graph
+	if a.metrics == nil {
+		klog.Warning("No metrics source configured, skipping aggregation")
+		return
+	}
+
+	a.lock.RLock()
+	nodes, namespaces, graphScopedEdgeGroups, quantile := a.nodes, a.namespaces, a.graphScopedEdgeGroups, a.quantile
+	a.lock.RUnlock()
+
+	histogramSource, ok := a.metrics.(HistogramSource)
+	if quantile > 0 && !ok {
+		// Averages must not be published as the percentile: the times published so far are withdrawn and the status tells why
+		klog.V(2).InfoS("The metrics source does not provide histograms, the percentile of the graph cannot be computed", "graph", a.graph)
+		a.publish(ctx, &Result{Graph: a.graph, Timestamp: time.Now(), PercentileUnsupported: true})
+		return
+	}
+
+	// Phase 1: get average pod response time (or its distribution, for percentiles) for each function in the graph
+	// Functions without ready pods (or without measurements) are left out and count as zero in the next phases
 	functionResponseTimes := make(map[string]float64)
-	functionPodCount := make(map[string]int)
-	for _, node := range a.nodes {
-		functionResponseTimes[node.FunctionName] = 0
-		functionPodCount[node.FunctionName] = 0
+	functionHistograms := make(map[string]*Histogram)
+	functionPods := make(map[string][]string)
+	for _, node := range nodes {
+		if ctx.Err() != nil {
+			break
+		}
+		namespace := namespaces[node.FunctionName]
+		pods, err := listReadyPods(ctx, a.client, namespace, node.FunctionName)
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			klog.ErrorS(err, "Failed to list pods", "function", node.FunctionName, "namespace", namespace)
+			continue
+		}
+		for _, pod := range pods {
+			functionPods[node.FunctionName] = append(functionPods[node.FunctionName], pod.Name)
+		}
+		if len(pods) == 0 {
+			klog.InfoS("Function has no ready pods, skipping", "function", node.FunctionName, "namespace", namespace)
+			continue
+		}
 
-		// Get Pods for Service{node.FunctionName}
-		// // Foreach Pod: get latest response time
+		function := Function{Name: node.FunctionName, Namespace: namespace, Pods: pods}
+		var responseTime float64
+		if quantile > 0 {
+			var histogram *Histogram
+			if histogram, err = histogramSource.ResponseTimeHistogram(ctx, function); err == nil {
+				functionHistograms[node.FunctionName] = histogram
+				responseTime = histogram.Quantile(quantile)
+			}
+		} else {
+			responseTime, err = a.metrics.ResponseTime(ctx, function)
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			if errors.Is(err, ErrNoMetrics) {
+				klog.InfoS("Function has no response time yet, skipping", "function", node.FunctionName, "namespace", namespace)
+			} else {
+				klog.ErrorS(err, "Failed to get response time", "function", node.FunctionName, "namespace", namespace)
+			}
+			continue
+		}
+		functionResponseTimes[node.FunctionName] = responseTime
 	}
-	for functioName, _ := range functionResponseTimes {
-		functionResponseTimes[functioName] /= float64(functionPodCount[functioName])
+	callRatios := a.observeCallRatios(ctx, nodes, namespaces)
+	entryRates := a.observeEntryRates(ctx, nodes, namespaces)
+
+	publishCtx := ctx
+	timedOut := false
+	if err := ctx.Err(); err != nil {
+		if !errors.Is(err, context.DeadlineExceeded) {
+			klog.InfoS("Aggregation canceled", "graph", a.graph)
+			return
+		}
+		klog.InfoS("Aggregation timed out before every function was measured", "graph", a.graph)
+		aggregationTimeouts.WithLabelValues(a.graph.Name, a.graph.Namespace).Inc()
+		timedOut = true
+		// The cycle is out of time, but the timeout itself still has to be reported
+		var cancel context.CancelFunc
+		publishCtx, cancel = context.WithTimeout(context.WithoutCancel(ctx), timeoutReportDeadline)
+		defer cancel()
+	}
+
+	// Phase 2 and 3: aggregate edge times and calculate external and end-to-end times, from both smoothed and raw measurements
+	var times, rawTimes graphTimes[float64]
+	smoothedResponseTimes := functionResponseTimes
+	if quantile > 0 {
+		// Distributions are not smoothed, so both times come from the latest ones
+		times = aggregatePercentiles(nodes, functionHistograms, callRatios, graphScopedEdgeGroups, quantile)
+		rawTimes = times
+	} else {
+		smoothedResponseTimes = a.smooth(functionResponseTimes)
+		times = aggregateEdgeGroups(nodes, smoothedResponseTimes, callRatios, graphScopedEdgeGroups)
+		rawTimes = aggregateEdgeGroups(nodes, functionResponseTimes, callRatios, graphScopedEdgeGroups)
+	}
+	requestRates := propagateRequestRates(nodes, entryRates, callRatios, times.endToEnd)
+	budgets := sloBudgets(nodes, smoothedResponseTimes, times)
+
+	// Phase 4: publish times
+	// The external response time is what must be subtracted from the response time target the kosmos recommender reads
+	// (see pkg/pod-autoscaler/pkg/recommender/controller.go [line 288]), the KosmosPublisher does it on its agreements
+	result := &Result{
+		Graph:         a.graph,
+		Timestamp:     time.Now(),
+		TimedOut:      timedOut,
+		Functions:     make(map[string]FunctionTimes, len(nodes)),
+		CriticalPaths: criticalPaths(nodes, smoothedResponseTimes, times),
+	}
+	for _, node := range nodes {
+		_, measured := functionResponseTimes[node.FunctionName]
+		requestRate, requestRateKnown := requestRates[node.FunctionName]
+		result.Functions[node.FunctionName] = FunctionTimes{
+			Name:                 node.FunctionName,
+			Namespace:            namespaces[node.FunctionName],
+			Pods:                 functionPods[node.FunctionName],
+			Measured:             measured,
+			ResponseTime:         smoothedResponseTimes[node.FunctionName],
+			ExternalResponseTime: times.external[node.FunctionName],
+			EndToEndResponseTime: times.endToEnd[node.FunctionName],
+			EdgeGroups:           times.edgeGroups[node.FunctionName],
+			ExpectedRequestRate:  requestRate,
+			RequestRateKnown:     requestRateKnown,
+			Budget:               budgetOf(budgets, node.FunctionName),
+			Raw: RawTimes{
+				ResponseTime:         functionResponseTimes[node.FunctionName],
+				ExternalResponseTime: rawTimes.external[node.FunctionName],
+				EndToEndResponseTime: rawTimes.endToEnd[node.FunctionName],
+			},
+		}
+	}
+	a.publish(publishCtx, result)
+}
+
+// publish hands the result of a cycle to every publisher
+func (a *Aggregator) publish(ctx context.Context, result *Result) {
+	for _, publisher := range a.publishers {
+		if err := publisher.Publish(ctx, result); err != nil {
+			klog.ErrorS(err, "Failed to publish graph times", "graph", a.graph)
+		}
+	}
+}
+
+// observeEntryRates gets the requests per second received by the entry functions of the graph
+func (a *Aggregator) observeEntryRates(ctx context.Context, nodes []FunctionNode, namespaces map[string]string) map[string]float64 {
+	entryRates := make(map[string]float64)
+	source, ok := a.metrics.(RequestRateSource)
+	if !ok {
+		return entryRates
+	}
+	for _, node := range entryFunctions(nodes) {
+		if ctx.Err() != nil {
+			break
+		}
+		function := Function{Name: node.FunctionName, Namespace: namespaces[node.FunctionName]}
+		rate, err := source.RequestRate(ctx, function)
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, ErrNoMetrics) {
+				klog.ErrorS(err, "Failed to get request rate", "function", function.Name, "namespace", function.Namespace)
+			}
+			continue
+		}
+		entryRates[node.FunctionName] = rate
+	}
+	return entryRates
+}
+
+// observeCallRatios gets the number of invocations per call of the caller along the edges that ask for the observed probability.
+// The edges without an observation fall back to their multiplier and probability.
+func (a *Aggregator) observeCallRatios(ctx context.Context, nodes []FunctionNode, namespaces map[string]string) map[invocationKey]float64 {
+	callRatios := make(map[invocationKey]float64)
+	source, ok := a.metrics.(CallRatioSource)
+	for _, node := range nodes {
+		for _, edge := range node.Invocations {
+			key := invocationKey{caller: node.FunctionName, callee: edge.FunctionName}
+			if _, observed := callRatios[key]; !edge.ObservedProbability || observed || ctx.Err() != nil {
+				continue
+			}
+			if !ok {
+				klog.V(2).InfoS("The metrics source does not provide call ratios, using the edge probability", "graph", a.graph, "caller", key.caller, "callee", key.callee)
+				continue
+			}
+
+			caller := Function{Name: node.FunctionName, Namespace: namespaces[node.FunctionName]}
+			callee := Function{Name: edge.FunctionName, Namespace: namespaces[edge.FunctionName]}
+			ratio, err := source.CallRatio(ctx, caller, callee)
+			if err != nil {
+				if ctx.Err() == nil && !errors.Is(err, ErrNoMetrics) {
+					klog.ErrorS(err, "Failed to get call ratio", "caller", key.caller, "callee", key.callee)
+				}
+				continue
+			}
+			callRatios[key] = ratio
+		}
+	}
+	return callRatios
+}
+
+// edgeGroupKey identifies a group of invocations that a caller performs concurrently
+type edgeGroupKey struct {
+	caller string
+	edgeId int32
+}
+
+// timeOps are the operations the times of a graph are computed with, either on averages or on distributions
+type timeOps[T any] struct {
+	zero T
+	// add combines the times of sequential invocations
+	add func(a, b T) T
+	// max combines the times of parallel invocations
+	max func(a, b T) T
+	// invoke returns the time spent on an edge whose function takes t, given how many times it is invoked in sequence
+	invoke func(t T, calls []callCount) T
+	// retry returns the time of an invocation that takes t, including the retries of its failures
+	retry func(t T, model retryModel) T
+}
+
+var meanOps = timeOps[float64]{
+	zero: 0,
+	add:  func(a, b float64) float64 { return a + b },
+	max:  func(a, b float64) float64 { return max(a, b) },
+	invoke: func(t float64, calls []callCount) float64 {
+		// Expected value over the number of invocations
+		expected := 0.0
+		for _, call := range calls {
+			expected += float64(call.count) * call.probability
+		}
+		return t * expected
+	},
+	retry: expectedRetriedTime,
+}
+
+var histogramOps = timeOps[*Histogram]{
+	zero: pointHistogram(0),
+	add:  (*Histogram).Add,
+	max:  (*Histogram).Max,
+	invoke: func(t *Histogram, calls []callCount) *Histogram {
+		histograms := make([]*Histogram, 0, len(calls))
+		weights := make([]float64, 0, len(calls))
+		for _, call := range calls {
+			histograms = append(histograms, t.Times(call.count))
+			weights = append(weights, call.probability)
+		}
+		return mixHistograms(histograms, weights)
+	},
+	retry: retriedHistogram,
+}
+
+// graphTimes are the times computed bottom-up through the graph, indexed by function name
+type graphTimes[T any] struct {
+	// edgeGroups are the aggregated times of the groups of invocations of each function, indexed by edge id
+	edgeGroups map[string]map[int32]T
+	// edges are the times of the invocations of each function, in the same order as the invocations of its node
+	edges map[string][]T
+	// external is the time each function spends waiting on the functions it invokes
+	external map[string]T
+	// endToEnd is the local time of each function plus its external time
+	endToEnd map[string]T
+}
+
+// aggregateEdgeGroups computes the average times of the graph from the average response times of its functions
+func aggregateEdgeGroups(nodes []FunctionNode, responseTimes map[string]float64, callRatios map[invocationKey]float64, graphScoped bool) graphTimes[float64] {
+	return aggregateTimes(nodes, responseTimes, callRatios, graphScoped, meanOps)
+}
+
+// aggregatePercentiles computes the times of the graph from the distributions of the response times of its functions,
+// and returns the given quantile of each of them
+func aggregatePercentiles(nodes []FunctionNode, histograms map[string]*Histogram, callRatios map[invocationKey]float64, graphScoped bool, quantile float64) graphTimes[float64] {
+	distributions := aggregateTimes(nodes, histograms, callRatios, graphScoped, histogramOps)
+	times := graphTimes[float64]{
+		edgeGroups: make(map[string]map[int32]float64, len(nodes)),
+		edges:      make(map[string][]float64, len(nodes)),
+		external:   make(map[string]float64, len(nodes)),
+		endToEnd:   make(map[string]float64, len(nodes)),
+	}
+	for _, node := range nodes {
+		edges := make([]float64, 0, len(distributions.edges[node.FunctionName]))
+		for _, distribution := range distributions.edges[node.FunctionName] {
+			edges = append(edges, distribution.Quantile(quantile))
+		}
+		times.edges[node.FunctionName] = edges
+		edgeGroups := make(map[int32]float64, len(distributions.edgeGroups[node.FunctionName]))
+		for edgeId, distribution := range distributions.edgeGroups[node.FunctionName] {
+			edgeGroups[edgeId] = distribution.Quantile(quantile)
+		}
+		times.edgeGroups[node.FunctionName] = edgeGroups
+		times.external[node.FunctionName] = distributions.external[node.FunctionName].Quantile(quantile)
+		times.endToEnd[node.FunctionName] = distributions.endToEnd[node.FunctionName].Quantile(quantile)
+	}
+	return times
+}
+
+// aggregateTimes computes the time of every edge group (the slowest of its invocations) and the external time of every
+// node (the sum of its edge groups, which run sequentially). Nodes must be sorted leaf first, so that the end-to-end time of
+// the callees is known when their callers are aggregated.
+// Edge groups are scoped to their caller unless graphScoped is set, which merges the edges with the same id across the graph.
+// Since a merged group can span callers at any depth, the legacy scope weighs the edges with the local times of the callees only,
+// and it adds the time of a group to the caller once for every invocation in it, like the times were computed before.
+// Edges are weighed by how many times they are invoked, on average, from their multiplier and probability or from the
+// call ratios observed between callers and callees, and every invocation includes its retries and is capped by its timeout.
+// Asynchronous invocations are left out of the groups, as the caller does not wait for them.
+func aggregateTimes[T any](nodes []FunctionNode, responseTimes map[string]T, callRatios map[invocationKey]float64, graphScoped bool, ops timeOps[T]) graphTimes[T] {
+	times := graphTimes[T]{
+		edgeGroups: make(map[string]map[int32]T, len(nodes)),
+		edges:      make(map[string][]T, len(nodes)),
+		external:   make(map[string]T, len(nodes)),
+		endToEnd:   make(map[string]T, len(nodes)),
+	}
+
+	// Functions that were not measured count as zero
+	responseTime := func(function string) T {
+		if t, ok := responseTimes[function]; ok {
+			return t
+		}
+		return ops.zero
+	}
+	groupKey := func(caller string, edgeId int32) edgeGroupKey {
+		if graphScoped {
+			return edgeGroupKey{edgeId: edgeId}
+		}
+		return edgeGroupKey{caller: caller, edgeId: edgeId}
+	}
+	observed := observedCalls(nodes, callRatios)
+	edgeTime := func(caller string, edge provisioningv1alpha1.InvocationEdge) T {
+		ratio, hasObserved := observed[invocationKey{caller: caller, callee: edge.FunctionName}]
+		calls := edgeCalls(edge, ratio, hasObserved)
+		invocation := times.endToEnd[edge.FunctionName]
+		if graphScoped {
+			invocation = responseTime(edge.FunctionName)
+		}
+		if model, ok := edgeRetryModel(edge); ok {
+			invocation = ops.retry(invocation, model)
+		}
+		return ops.invoke(invocation, calls)
 	}
 
 	// Phase 2: aggregate edge times
-	graphEdgeAggregations := make(map[int32]float64)
-	for _, node := range a.nodes {
+	edgeAggregations := make(map[edgeGroupKey]T)
+	aggregateEdges := func(node FunctionNode) {
+		edges := make([]T, 0, len(node.Invocations))
 		for _, edge := range node.Invocations {
-			currFunctionEdgeValue := functionResponseTimes[edge.FunctionName] * float64(edge.EdgeMultiplier)
-			if val, ok := graphEdgeAggregations[edge.EdgeId]; ok {
+			if !edge.IsSync() {
+				// The caller does not wait for asynchronous invocations
+				edges = append(edges, ops.zero)
+				continue
+			}
+			key := groupKey(node.FunctionName, edge.EdgeId)
+			currFunctionEdgeValue := edgeTime(node.FunctionName, edge)
+			edges = append(edges, currFunctionEdgeValue)
+			if val, ok := edgeAggregations[key]; ok {
 				// If edge id was already seen it means this is a parallel call, so we take the slower time
-				graphEdgeAggregations[edge.EdgeId] = max(val, currFunctionEdgeValue)
+				edgeAggregations[key] = ops.max(val, currFunctionEdgeValue)
 			} else {
 				// This is either a sequential call or the first time we see a parallel call (therefore this is the slower so far)
-				graphEdgeAggregations[edge.EdgeId] = currFunctionEdgeValue
+				edgeAggregations[key] = currFunctionEdgeValue
 			}
 		}
+		times.edges[node.FunctionName] = edges
+	}
+	if graphScoped {
+		// Groups are shared between callers, so they must be complete before any external time is computed
+		for _, node := range nodes {
+			aggregateEdges(node)
+		}
 	}
 
-	// Phase 3: calculate external times
-	// TODO: this could be integrated in the same loop for phase 2
-	nodeExternalResponseTimes := make(map[string]float64)
-	for _, node := range a.nodes {
-		// If the node is a leaf, external response time is zero :)
-		if len(node.Invocations) < 1 {
-			nodeExternalResponseTimes[node.FunctionName] = 0
-			continue
+	// Phase 3: calculate external and end-to-end times, bottom-up
+	for _, node := range nodes {
+		if !graphScoped {
+			aggregateEdges(node)
 		}
 
-		sum := 0.0
+		// If the node is a leaf, external response time is zero :)
+		edgeGroups := make(map[int32]T)
+		edgeIds := []int32{}
 		for _, edge := range node.Invocations {
-			sum += graphEdgeAggregations[edge.EdgeId]
+			if !edge.IsSync() {
+				continue
+			}
+			if _, ok := edgeGroups[edge.EdgeId]; !ok {
+				edgeIds = append(edgeIds, edge.EdgeId)
+			}
+			edgeGroups[edge.EdgeId] = edgeAggregations[groupKey(node.FunctionName, edge.EdgeId)]
 		}
-		nodeExternalResponseTimes[node.FunctionName] = sum
-	}
 
-	// Phase 4: publish times
-	for functionName, externalResponseTime := range nodeExternalResponseTimes {
-		// TODO: missing metric publisher implementation (var block just to dismiss error for now)
-		var (
-			_ = functionName
-			_ = externalResponseTime
-		)
-
-		// TODO: there are three options
-		/*
-			1 - publish as service metric
-			2 - publish as pod metric
-			3 - publish as something different
-
-			this influences how the metric is accessed by the kosmos recommender at
-			pkg/pod-autoscaler/pkg/recommender/controller.go [line 288]
-		*/
+		// Each group counts once, no matter how many parallel invocations it has
+		sum := ops.zero
+		slices.Sort(edgeIds)
+		for _, edgeId := range edgeIds {
+			sum = ops.add(sum, edgeGroups[edgeId])
+		}
+		if graphScoped {
+			// The legacy scope adds the group once per invocation instead, as the times were computed before groups were scoped
+			sum = ops.zero
+			for _, edge := range node.Invocations {
+				if edge.IsSync() {
+					sum = ops.add(sum, edgeGroups[edge.EdgeId])
+				}
+			}
+		}
+		times.edgeGroups[node.FunctionName] = edgeGroups
+		times.external[node.FunctionName] = sum
+		times.endToEnd[node.FunctionName] = ops.add(responseTime(node.FunctionName), sum)
 	}
+
+	return times
 }
@@ -0,0 +1,422 @@
+package aggregator
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	provisioningv1alpha1 "github.com/itspeetah/neptune-depdag-controller/api/v1alpha1"
+	functionnodestest "github.com/itspeetah/neptune-depdag-controller/test/function-nodes"
+)
+
+// blockingMetrics waits for the context to be done before returning
+type blockingMetrics struct{}
+
+func (blockingMetrics) ResponseTime(ctx context.Context, function Function) (float64, error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+// resultsPublisher keeps the results it is asked to publish
+type resultsPublisher struct {
+	lock    sync.Mutex
+	results []*Result
+}
+
+func (p *resultsPublisher) Publish(ctx context.Context, result *Result) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.results = append(p.results, result)
+	return nil
+}
+
+func (p *resultsPublisher) Retract(ctx context.Context, graph types.NamespacedName) error {
+	return nil
+}
+
+// histogramMetrics returns the same histogram for every function
+type histogramMetrics struct {
+	histogram *Histogram
+}
+
+func (m histogramMetrics) ResponseTime(ctx context.Context, function Function) (float64, error) {
+	return 0, ErrNoMetrics
+}
+
+func (m histogramMetrics) ResponseTimeHistogram(ctx context.Context, function Function) (*Histogram, error) {
+	return m.histogram, nil
+}
+
+var _ = Describe("Aggregator", func() {
+	names := func(nodes []FunctionNode) []string {
+		result := []string{}
+		for _, node := range nodes {
+			result = append(result, node.FunctionName)
+		}
+		return result
+	}
+
+	Context("sorting the nodes", func() {
+		It("should put the leaves first", func() {
+			sorted := names(sortNodesByDependencies(functionnodestest.NodesInput1))
+			Expect(sorted).To(HaveLen(5))
+			Expect(sorted[:2]).To(ConsistOf("C", "E"))
+			Expect(sorted[2:]).To(Equal([]string{"D", "B", "A"}))
+
+			sorted = names(sortNodesByDependencies(functionnodestest.NodesInput2))
+			Expect(sorted).To(HaveLen(11))
+			Expect(sorted[:5]).To(ConsistOf("F", "G", "H", "L", "M"))
+			Expect(sorted[5:7]).To(ConsistOf("C", "I"))
+			Expect(sorted[7:]).To(Equal([]string{"E", "D", "B", "A"}))
+		})
+	})
+
+	Context("aggregating edge groups", func() {
+		responseTimes := map[string]float64{
+			"A": 0.1, "B": 0.2, "C": 0.3, "D": 0.4, "E": 0.5, "F": 0.6,
+			"G": 0.7, "H": 0.8, "I": 0.9, "L": 1.0, "M": 1.1,
+		}
+
+		// expectTimes checks the times of the given functions, as {external, end-to-end} pairs
+		expectTimes := func(times graphTimes[float64], expected map[string][2]float64) {
+			for function, values := range expected {
+				Expect(times.external[function]).To(BeNumerically("~", values[0]), "external time of %s", function)
+				Expect(times.endToEnd[function]).To(BeNumerically("~", values[1]), "end-to-end time of %s", function)
+			}
+		}
+
+		It("should compute the end-to-end times bottom-up with edge groups scoped to the calling node", func() {
+			times := aggregateEdgeGroups(sortNodesByDependencies(functionnodestest.NodesInput1), responseTimes, nil, false)
+			expectTimes(times, map[string][2]float64{
+				"C": {0, 0.3},
+				"E": {0, 0.5},
+				"D": {0.5, 0.9},
+				// C and D are invoked in parallel, so only the slowest counts
+				"B": {0.9, 1.1},
+				"A": {1.1, 1.2},
+			})
+			Expect(times.edgeGroups["B"]).To(HaveKeyWithValue(int32(1), BeNumerically("~", 0.9)))
+			Expect(times.edgeGroups["C"]).To(BeEmpty())
+
+			times = aggregateEdgeGroups(sortNodesByDependencies(functionnodestest.NodesInput2), responseTimes, nil, false)
+			expectTimes(times, map[string][2]float64{
+				"M": {0, 1.1},
+				"I": {1.1, 2.0},
+				"C": {0.7, 1.0},
+				"E": {2.0, 2.5},
+				"D": {2.5, 2.9},
+				"B": {2.9, 3.1},
+				"A": {3.1, 3.2},
+			})
+		})
+
+		It("should add up sequential edge groups", func() {
+			nodes := []FunctionNode{
+				{FunctionName: "A", Invocations: []provisioningv1alpha1.InvocationEdge{
+					{FunctionName: "B", EdgeId: 1, EdgeMultiplier: 2},
+					{FunctionName: "C", EdgeId: 2, EdgeMultiplier: 1},
+					{FunctionName: "D", EdgeId: 2, EdgeMultiplier: 1},
+				}},
+				{FunctionName: "B"}, {FunctionName: "C"}, {FunctionName: "D"},
+			}
+			times := aggregateEdgeGroups(sortNodesByDependencies(nodes), responseTimes, nil, false)
+			Expect(times.edgeGroups["A"]).To(Equal(map[int32]float64{1: 0.4, 2: 0.4}))
+			expectTimes(times, map[string][2]float64{"A": {0.8, 0.9}})
+		})
+
+		It("should merge edges with the same id across the graph with the legacy scope", func() {
+			times := aggregateEdgeGroups(sortNodesByDependencies(functionnodestest.NodesInput1), responseTimes, nil, true)
+			// Every edge has id 1, so every caller waits for the slowest local time invoked in the graph,
+			// once for each of its invocations
+			expectTimes(times, map[string][2]float64{
+				"A": {0.5, 0.6},
+				"B": {1.0, 1.2},
+				"D": {0.5, 0.9},
+				"C": {0, 0.3},
+			})
+		})
+
+		It("should count unmeasured functions as zero", func() {
+			times := aggregateEdgeGroups(sortNodesByDependencies(functionnodestest.NodesInput1), map[string]float64{"C": 0.3}, nil, false)
+			expectTimes(times, map[string][2]float64{
+				"D": {0, 0},
+				"B": {0.3, 0.3},
+				"A": {0.3, 0.3},
+			})
+		})
+	})
+
+	Context("aggregating asynchronous edges", func() {
+		It("should leave them out of the time of the caller", func() {
+			nodes := sortNodesByDependencies([]FunctionNode{
+				{FunctionName: "A", Invocations: []provisioningv1alpha1.InvocationEdge{
+					{FunctionName: "B", EdgeId: 1, EdgeMultiplier: 1},
+					{FunctionName: "C", EdgeId: 1, EdgeMultiplier: 1, Kind: provisioningv1alpha1.EdgeKindAsync},
+					{FunctionName: "C", EdgeId: 2, EdgeMultiplier: 3, Kind: provisioningv1alpha1.EdgeKindStream},
+				}},
+				{FunctionName: "B"},
+				{FunctionName: "C"},
+			})
+			times := aggregateEdgeGroups(nodes, map[string]float64{"A": 0.1, "B": 0.2, "C": 0.5}, nil, false)
+			Expect(times.edgeGroups["A"]).To(Equal(map[int32]float64{1: 0.2}))
+			Expect(times.external["A"]).To(BeNumerically("~", 0.2, 1e-9))
+			Expect(times.endToEnd["A"]).To(BeNumerically("~", 0.3, 1e-9))
+		})
+	})
+
+	Context("weighing the edges by their invocations", func() {
+		half := resource.MustParse("0.5")
+		nodes := sortNodesByDependencies([]FunctionNode{
+			{FunctionName: "A", Invocations: []provisioningv1alpha1.InvocationEdge{
+				{FunctionName: "B", EdgeId: 1, EdgeMultiplier: 2, Probability: &half},
+				{FunctionName: "C", EdgeId: 2, EdgeMultiplier: 1, ObservedProbability: true},
+				{FunctionName: "C", EdgeId: 3, EdgeMultiplier: 1, ObservedProbability: true},
+			}},
+			{FunctionName: "B"},
+			{FunctionName: "C"},
+		})
+		responseTimes := map[string]float64{"A": 0.1, "B": 0.2, "C": 0.4}
+
+		It("should use the expected number of invocations", func() {
+			times := aggregateEdgeGroups(nodes, responseTimes, nil, false)
+			Expect(times.edgeGroups["A"][1]).To(BeNumerically("~", 0.2, 1e-9))
+			// Without observations the edges fall back to their multiplier
+			Expect(times.edgeGroups["A"][2]).To(BeNumerically("~", 0.4, 1e-9))
+		})
+
+		It("should split the observed invocations between the edges to the same function", func() {
+			times := aggregateEdgeGroups(nodes, responseTimes, map[invocationKey]float64{{caller: "A", callee: "C"}: 0.5}, false)
+			Expect(times.edgeGroups["A"][2]).To(BeNumerically("~", 0.1, 1e-9))
+			Expect(times.edgeGroups["A"][3]).To(BeNumerically("~", 0.1, 1e-9))
+		})
+
+		It("should mix the distributions of the number of invocations", func() {
+			histograms := map[string]*Histogram{"B": pointHistogram(0.2), "C": pointHistogram(0.4)}
+			times := aggregatePercentiles(nodes, histograms, map[invocationKey]float64{{caller: "A", callee: "C"}: 3}, false, 0.5)
+			// B is invoked twice half of the times, and not at all otherwise
+			Expect(times.edgeGroups["A"][1]).To(BeNumerically("~", 0, 1e-9))
+			Expect(aggregatePercentiles(nodes, histograms, nil, false, 1).edgeGroups["A"][1]).To(BeNumerically("~", 0.4, 1e-9))
+			// C is invoked 1.5 times per edge, once or twice with the same probability
+			Expect(times.edgeGroups["A"][2]).To(BeNumerically("~", 0.4, 1e-9))
+			Expect(aggregatePercentiles(nodes, histograms, map[invocationKey]float64{{caller: "A", callee: "C"}: 3}, false, 1).edgeGroups["A"][2]).
+				To(BeNumerically("~", 0.8, 1e-9))
+		})
+	})
+
+	Context("aggregating percentiles", func() {
+		It("should match the averages when every time is always the same", func() {
+			nodes := sortNodesByDependencies(functionnodestest.NodesInput1)
+			responseTimes := map[string]float64{"A": 0.1, "B": 0.2, "C": 0.3, "D": 0.4, "E": 0.5}
+			histograms := map[string]*Histogram{}
+			for function, responseTime := range responseTimes {
+				histograms[function] = pointHistogram(responseTime)
+			}
+
+			percentiles := aggregatePercentiles(nodes, histograms, nil, false, 0.95)
+			means := aggregateEdgeGroups(nodes, responseTimes, nil, false)
+			for function := range responseTimes {
+				Expect(percentiles.external[function]).To(BeNumerically("~", means.external[function], 1e-9))
+				Expect(percentiles.endToEnd[function]).To(BeNumerically("~", means.endToEnd[function], 1e-9))
+			}
+		})
+
+		It("should propagate the distributions through parallel and sequential invocations", func() {
+			nodes := sortNodesByDependencies([]FunctionNode{
+				{FunctionName: "A", Invocations: []provisioningv1alpha1.InvocationEdge{
+					{FunctionName: "B", EdgeId: 1, EdgeMultiplier: 1},
+					{FunctionName: "C", EdgeId: 1, EdgeMultiplier: 1},
+					{FunctionName: "C", EdgeId: 2, EdgeMultiplier: 2},
+				}},
+				{FunctionName: "B"},
+				{FunctionName: "C"},
+			})
+			// B and C take either 1 or 2 seconds
+			twoValues := &Histogram{points: []histogramPoint{{value: 1, probability: 0.5}, {value: 2, probability: 0.5}}}
+			histograms := map[string]*Histogram{"B": twoValues, "C": twoValues}
+
+			times := aggregatePercentiles(nodes, histograms, nil, false, 0.25)
+			// Both parallel invocations take 1 second a quarter of the times
+			Expect(times.edgeGroups["A"][1]).To(BeNumerically("~", 1, 1e-9))
+			// Two invocations in sequence take 2, 3 or 4 seconds with probabilities 1/4, 1/2, 1/4
+			Expect(times.edgeGroups["A"][2]).To(BeNumerically("~", 2, 1e-9))
+			Expect(times.external["A"]).To(BeNumerically(">", 3))
+			Expect(times.external["A"]).To(BeNumerically("<", 4))
+		})
+
+		It("should compute the percentile in a cycle when the metrics source provides histograms", func() {
+			graph := &DependencyGraph{ObjectMeta: metav1.ObjectMeta{Namespace: "fn", Name: "graph"}}
+			graph.Spec.Nodes = []FunctionNode{{FunctionName: "A"}}
+			graph.Spec.Percentile = 95
+			client := fake.NewClientBuilder().WithObjects(
+				&corev1.Service{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "fn", Name: "A"},
+					Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "A"}},
+				},
+				&corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "fn", Name: "a-1", Labels: map[string]string{"app": "A"}},
+					Status: corev1.PodStatus{
+						Phase:      corev1.PodRunning,
+						Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+					},
+				},
+			).Build()
+			histogram := &Histogram{points: []histogramPoint{{value: 0.1, probability: 0.9}, {value: 1, probability: 0.1}}}
+			publisher := &resultsPublisher{}
+			NewAggregator(graph, client, histogramMetrics{histogram: histogram}, publisher).Aggregate(context.Background())
+
+			Expect(publisher.results).To(HaveLen(1))
+			Expect(publisher.results[0].Functions["A"].Measured).To(BeTrue())
+			Expect(publisher.results[0].Functions["A"].ResponseTime).To(BeNumerically("~", histogram.Quantile(0.95), 1e-9))
+			Expect(publisher.results[0].Functions["A"].EndToEndResponseTime).To(BeNumerically("~", histogram.Quantile(0.95), 1e-9))
+		})
+
+		It("should publish no times when the metrics source does not provide histograms", func() {
+			graph := &DependencyGraph{ObjectMeta: metav1.ObjectMeta{Namespace: "fn", Name: "graph"}}
+			graph.Spec.Nodes = []FunctionNode{{FunctionName: "A"}}
+			graph.Spec.Percentile = 95
+			publisher := &resultsPublisher{}
+			// The averages of the source must not be published as the percentile
+			NewAggregator(graph, fake.NewClientBuilder().Build(), blockingMetrics{}, publisher).Aggregate(context.Background())
+
+			Expect(publisher.results).To(HaveLen(1))
+			Expect(publisher.results[0].PercentileUnsupported).To(BeTrue())
+			Expect(publisher.results[0].Functions).To(BeEmpty())
+		})
+	})
+
+	Context("reading the edge group scope", func() {
+		It("should default to the node scope", func() {
+			graph := &DependencyGraph{}
+			Expect(NewAggregator(graph, nil, nil).graphScopedEdgeGroups).To(BeFalse())
+
+			graph.Annotations = map[string]string{provisioningv1alpha1.EdgeGroupScopeAnnotation: provisioningv1alpha1.EdgeGroupScopeGraph}
+			Expect(NewAggregator(graph, nil, nil).graphScopedEdgeGroups).To(BeTrue())
+		})
+	})
+
+	Context("resolving the function namespaces", func() {
+		It("should prefer the node namespace, then the function namespace of the graph, then the graph namespace", func() {
+			graph := &DependencyGraph{}
+			graph.Namespace = "control"
+			graph.Spec.Nodes = []FunctionNode{{FunctionName: "A"}, {FunctionName: "B", Namespace: "other"}}
+			Expect(NewAggregator(graph, nil, nil).namespaces).To(Equal(map[string]string{"A": "control", "B": "other"}))
+
+			graph.Spec.FunctionNamespace = "openfaas-fn"
+			Expect(NewAggregator(graph, nil, nil).namespaces).To(Equal(map[string]string{"A": "openfaas-fn", "B": "other"}))
+		})
+	})
+
+	Context("updating the graph", func() {
+		It("should swap the nodes and the edge group scope", func() {
+			graph := &DependencyGraph{}
+			graph.Spec.Nodes = functionnodestest.NodesInput1
+			a := NewAggregator(graph, nil, nil)
+			Expect(a.nodes).To(HaveLen(5))
+
+			graph = graph.DeepCopy()
+			graph.Annotations = map[string]string{provisioningv1alpha1.EdgeGroupScopeAnnotation: provisioningv1alpha1.EdgeGroupScopeGraph}
+			graph.Spec.Nodes = functionnodestest.NodesInput2
+			a.Update(graph)
+			Expect(a.nodes).To(HaveLen(11))
+			Expect(a.namespaces).To(HaveLen(11))
+			Expect(a.graphScopedEdgeGroups).To(BeTrue())
+		})
+	})
+
+	Context("smoothing the response times", func() {
+		var graph *DependencyGraph
+
+		BeforeEach(func() {
+			graph = &DependencyGraph{}
+			graph.Spec.Nodes = []FunctionNode{{FunctionName: "A"}, {FunctionName: "B"}}
+			graph.Spec.Smoothing = &provisioningv1alpha1.Smoothing{Method: provisioningv1alpha1.SmoothingWindowMean, Window: 2}
+		})
+
+		It("should use the measurements as they are without smoothing", func() {
+			graph.Spec.Smoothing = nil
+			a := NewAggregator(graph, nil, nil)
+			Expect(a.smooth(map[string]float64{"A": 1})).To(Equal(map[string]float64{"A": 1}))
+			Expect(a.smooth(map[string]float64{"A": 3})).To(Equal(map[string]float64{"A": 3}))
+		})
+
+		It("should keep the state of each function across cycles", func() {
+			a := NewAggregator(graph, nil, nil)
+			Expect(a.smooth(map[string]float64{"A": 1, "B": 2})).To(Equal(map[string]float64{"A": 1, "B": 2}))
+			Expect(a.smooth(map[string]float64{"A": 3})).To(Equal(map[string]float64{"A": 2, "B": 2}))
+			Expect(a.smooth(map[string]float64{"A": 5, "B": 4})).To(Equal(map[string]float64{"A": 4, "B": 3}))
+		})
+
+		It("should keep the state across updates of the graph, unless the smoothing changes", func() {
+			a := NewAggregator(graph, nil, nil)
+			a.smooth(map[string]float64{"A": 1, "B": 2})
+
+			updated := graph.DeepCopy()
+			updated.Spec.Nodes = []FunctionNode{{FunctionName: "A"}}
+			a.Update(updated)
+			Expect(a.smoothers).To(HaveLen(1))
+			Expect(a.smooth(map[string]float64{"A": 3})).To(Equal(map[string]float64{"A": 2}))
+
+			updated = updated.DeepCopy()
+			updated.Spec.Smoothing.Window = 3
+			a.Update(updated)
+			Expect(a.smooth(map[string]float64{"A": 5})).To(Equal(map[string]float64{"A": 5}))
+		})
+	})
+
+	Context("running a cycle", func() {
+		var (
+			graph     *DependencyGraph
+			publisher *resultsPublisher
+			a         *Aggregator
+		)
+
+		BeforeEach(func() {
+			graph = &DependencyGraph{ObjectMeta: metav1.ObjectMeta{Namespace: "fn", Name: "graph"}}
+			graph.Spec.Nodes = []FunctionNode{{FunctionName: "A"}}
+			client := fake.NewClientBuilder().WithObjects(
+				&corev1.Service{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "fn", Name: "A"},
+					Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "A"}},
+				},
+				&corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "fn", Name: "a-1", Labels: map[string]string{"app": "A"}},
+					Status: corev1.PodStatus{
+						Phase:      corev1.PodRunning,
+						Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+					},
+				},
+			).Build()
+			publisher = &resultsPublisher{}
+			a = NewAggregator(graph, client, blockingMetrics{}, publisher)
+		})
+
+		It("should report the cycles that run out of time", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			a.Aggregate(ctx)
+
+			Expect(publisher.results).To(HaveLen(1))
+			Expect(publisher.results[0].TimedOut).To(BeTrue())
+			Expect(publisher.results[0].Functions["A"].Pods).To(Equal([]string{"a-1"}))
+			Expect(publisher.results[0].Functions["A"].Measured).To(BeFalse())
+			Expect(testutil.ToFloat64(aggregationTimeouts.WithLabelValues("graph", "fn"))).To(Equal(1.0))
+		})
+
+		It("should publish nothing when the cycle is canceled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(20*time.Millisecond, cancel)
+			a.Aggregate(ctx)
+
+			Expect(publisher.results).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,76 @@
+package aggregator
+
+// Budget is the share of the response time SLOs of the graph assigned to a function, in seconds
+type Budget struct {
+	// EndToEnd is the time the function can take including the functions it waits for
+	EndToEnd float64
+	// ResponseTime is the time the function itself can take, its response time target
+	ResponseTime float64
+}
+
+// budgetOf returns the budget of the function, nil if it has none
+func budgetOf(budgets map[string]Budget, function string) *Budget {
+	if budget, ok := budgets[function]; ok {
+		return &budget
+	}
+	return nil
+}
+
+// sloBudgets splits the response time SLO of every entry function down the functions it waits for.
+// The budget of a function is shared between its local time and its sequential groups of invocations in proportion
+// to their times, and every invocation of a group can take the whole budget of the group, scaled like its time is
+// (by the multiplier, probability and retries of the edge). This way the slowest chains get a budget that is the
+// same fraction of their current time as the SLO is of the end-to-end time of the entry, while the others get some slack.
+// A function on the paths of several SLOs gets the tightest budget. Nodes must be sorted leaf first.
+func sloBudgets(nodes []FunctionNode, responseTimes map[string]float64, times graphTimes[float64]) map[string]Budget {
+	endToEndBudgets := make(map[string]float64)
+	for _, node := range nodes {
+		if node.ResponseTimeSLO != nil {
+			endToEndBudgets[node.FunctionName] = node.ResponseTimeSLO.Seconds()
+		}
+	}
+	assign := func(function string, budget float64) {
+		if current, ok := endToEndBudgets[function]; !ok || budget < current {
+			endToEndBudgets[function] = budget
+		}
+	}
+
+	budgets := make(map[string]Budget, len(endToEndBudgets))
+	// Callers first, so that a function has received the budgets of all its callers before splitting its own
+	for i := len(nodes) - 1; i >= 0; i-- {
+		node := nodes[i]
+		endToEndBudget, ok := endToEndBudgets[node.FunctionName]
+		if !ok {
+			continue
+		}
+
+		edgeGroups := times.edgeGroups[node.FunctionName]
+		local := responseTimes[node.FunctionName]
+		total := local + times.external[node.FunctionName]
+		// share returns the part of the budget of the node for a time of the node, evenly split if nothing was measured
+		share := func(t float64) float64 {
+			if total <= 0 {
+				return endToEndBudget / float64(1+len(edgeGroups))
+			}
+			return endToEndBudget * t / total
+		}
+		budgets[node.FunctionName] = Budget{EndToEnd: endToEndBudget, ResponseTime: share(local)}
+
+		edges := times.edges[node.FunctionName]
+		for j, edge := range node.Invocations {
+			if !edge.IsSync() {
+				// The caller does not wait for the function, so its latency is not part of the budget
+				continue
+			}
+			groupBudget := share(edgeGroups[edge.EdgeId])
+			// The edge takes its time as many times as it invokes the function, and so does its budget
+			calleeEndToEnd := times.endToEnd[edge.FunctionName]
+			if j < len(edges) && edges[j] > 0 && calleeEndToEnd > 0 {
+				assign(edge.FunctionName, groupBudget*calleeEndToEnd/edges[j])
+			} else {
+				assign(edge.FunctionName, groupBudget/float64(max(edge.EdgeMultiplier, 1)))
+			}
+		}
+	}
+	return budgets
+}
@@ -0,0 +1,82 @@
+package aggregator
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	provisioningv1alpha1 "github.com/itspeetah/neptune-depdag-controller/api/v1alpha1"
+)
+
+var _ = Describe("SLO budgets", func() {
+	slo := func(seconds float64) *metav1.Duration {
+		return &metav1.Duration{Duration: time.Duration(seconds * float64(time.Second))}
+	}
+
+	It("should split the SLO of an entry function in proportion to the times along the graph", func() {
+		nodes := sortNodesByDependencies([]FunctionNode{
+			{FunctionName: "A", ResponseTimeSLO: slo(0.5), Invocations: []provisioningv1alpha1.InvocationEdge{
+				{FunctionName: "B", EdgeId: 1, EdgeMultiplier: 1},
+				{FunctionName: "C", EdgeId: 1, EdgeMultiplier: 1},
+				{FunctionName: "D", EdgeId: 2, EdgeMultiplier: 1},
+			}},
+			{FunctionName: "B"},
+			{FunctionName: "C", Invocations: []provisioningv1alpha1.InvocationEdge{{FunctionName: "E", EdgeId: 1, EdgeMultiplier: 1}}},
+			{FunctionName: "D"},
+			{FunctionName: "E"},
+			{FunctionName: "F"},
+		})
+		responseTimes := map[string]float64{"A": 0.1, "B": 0.5, "C": 0.2, "D": 0.3, "E": 0.4, "F": 0.1}
+		budgets := sloBudgets(nodes, responseTimes, aggregateEdgeGroups(nodes, responseTimes, nil, false))
+
+		// A takes 1s end to end, so the slowest chain A, C, E, D gets half of its times
+		Expect(budgets["A"].EndToEnd).To(BeNumerically("~", 0.5, 1e-9))
+		Expect(budgets["A"].ResponseTime).To(BeNumerically("~", 0.05, 1e-9))
+		Expect(budgets["C"].EndToEnd).To(BeNumerically("~", 0.3, 1e-9))
+		Expect(budgets["C"].ResponseTime).To(BeNumerically("~", 0.1, 1e-9))
+		Expect(budgets["E"].ResponseTime).To(BeNumerically("~", 0.2, 1e-9))
+		Expect(budgets["D"].ResponseTime).To(BeNumerically("~", 0.15, 1e-9))
+		// B runs in parallel with C and E, so it can take the whole budget of the group
+		Expect(budgets["B"].ResponseTime).To(BeNumerically("~", 0.3, 1e-9))
+		Expect(budgets).NotTo(HaveKey("F"))
+	})
+
+	It("should give the tightest budget to the functions under several SLOs", func() {
+		nodes := sortNodesByDependencies([]FunctionNode{
+			{FunctionName: "A", ResponseTimeSLO: slo(0.6), Invocations: []provisioningv1alpha1.InvocationEdge{
+				{FunctionName: "C", EdgeId: 1, EdgeMultiplier: 1},
+			}},
+			{FunctionName: "B", ResponseTimeSLO: slo(0.55), Invocations: []provisioningv1alpha1.InvocationEdge{
+				{FunctionName: "C", EdgeId: 1, EdgeMultiplier: 2},
+			}},
+			{FunctionName: "C"},
+		})
+		responseTimes := map[string]float64{"A": 0.1, "B": 0.1, "C": 0.5}
+		budgets := sloBudgets(nodes, responseTimes, aggregateEdgeGroups(nodes, responseTimes, nil, false))
+
+		// A leaves 0.5s to C, B leaves 0.5s to the two invocations of C
+		Expect(budgets["C"].ResponseTime).To(BeNumerically("~", 0.25, 1e-9))
+		Expect(budgets["C"].EndToEnd).To(BeNumerically("~", 0.25, 1e-9))
+	})
+
+	It("should split the budget evenly when nothing was measured and skip the asynchronous invocations", func() {
+		nodes := sortNodesByDependencies([]FunctionNode{
+			{FunctionName: "A", ResponseTimeSLO: slo(1), Invocations: []provisioningv1alpha1.InvocationEdge{
+				{FunctionName: "B", EdgeId: 1, EdgeMultiplier: 2},
+				{FunctionName: "C", EdgeId: 2, EdgeMultiplier: 1},
+				{FunctionName: "D", EdgeId: 3, EdgeMultiplier: 1, Kind: provisioningv1alpha1.EdgeKindAsync},
+			}},
+			{FunctionName: "B"},
+			{FunctionName: "C"},
+			{FunctionName: "D"},
+		})
+		budgets := sloBudgets(nodes, map[string]float64{}, aggregateEdgeGroups(nodes, map[string]float64{}, nil, false))
+
+		Expect(budgets["A"].ResponseTime).To(BeNumerically("~", 1.0/3, 1e-9))
+		Expect(budgets["B"].ResponseTime).To(BeNumerically("~", 1.0/6, 1e-9))
+		Expect(budgets["C"].ResponseTime).To(BeNumerically("~", 1.0/3, 1e-9))
+		Expect(budgets).NotTo(HaveKey("D"))
+	})
+})
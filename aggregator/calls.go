@@ -0,0 +1,64 @@
+package aggregator
+
+import (
+	"math"
+
+	provisioningv1alpha1 "github.com/itspeetah/neptune-depdag-controller/api/v1alpha1"
+)
+
+// invocationKey identifies the invocations from a caller to a callee, across all the edges between them
+type invocationKey struct {
+	caller string
+	callee string
+}
+
+// callCount is a number of invocations performed along an edge, with its probability
+type callCount struct {
+	count       int32
+	probability float64
+}
+
+// edgeCalls returns how many times a call of the caller invokes the function of the edge.
+// Without an observation, the edge invokes the function EdgeMultiplier times with its probability, and never otherwise.
+// An observed (average) number of invocations is split between the two integers around it, so that the average matches.
+func edgeCalls(edge provisioningv1alpha1.InvocationEdge, observed float64, hasObserved bool) []callCount {
+	if hasObserved && edge.ObservedProbability {
+		observed = max(observed, 0)
+		count := math.Floor(observed)
+		fraction := observed - count
+		if fraction == 0 {
+			return []callCount{{count: int32(count), probability: 1}}
+		}
+		return []callCount{{count: int32(count), probability: 1 - fraction}, {count: int32(count) + 1, probability: fraction}}
+	}
+
+	probability := 1.0
+	if edge.Probability != nil {
+		probability = min(max(edge.Probability.AsApproximateFloat64(), 0), 1)
+	}
+	if probability == 1 {
+		return []callCount{{count: edge.EdgeMultiplier, probability: 1}}
+	}
+	return []callCount{{count: 0, probability: 1 - probability}, {count: edge.EdgeMultiplier, probability: probability}}
+}
+
+// observedCalls returns the observed number of invocations per call of the caller along each edge that asks for it.
+// The invocations observed between a caller and a callee are split evenly between the edges that connect them.
+func observedCalls(nodes []FunctionNode, callRatios map[invocationKey]float64) map[invocationKey]float64 {
+	edges := make(map[invocationKey]int)
+	for _, node := range nodes {
+		for _, edge := range node.Invocations {
+			if edge.ObservedProbability {
+				edges[invocationKey{caller: node.FunctionName, callee: edge.FunctionName}]++
+			}
+		}
+	}
+
+	perEdge := make(map[invocationKey]float64, len(callRatios))
+	for key, ratio := range callRatios {
+		if edges[key] > 0 {
+			perEdge[key] = ratio / float64(edges[key])
+		}
+	}
+	return perEdge
+}
@@ -0,0 +1,108 @@
+package aggregator
+
+import (
+	"sort"
+
+	provisioningv1alpha1 "github.com/itspeetah/neptune-depdag-controller/api/v1alpha1"
+)
+
+// CriticalPathStep is a function along a critical path
+type CriticalPathStep struct {
+	Function string
+	// EdgeId is the group of invocations the previous function invokes this one in, nil for the entry function
+	EdgeId *int32
+	// ResponseTime is the local response time of the function, in seconds
+	ResponseTime float64
+}
+
+// CriticalPath is the chain of invocations that dominates the end-to-end response time of an entry function
+type CriticalPath struct {
+	// Entry is the function the path starts from, which no other function of the graph waits for
+	Entry string
+	// Steps go from the entry function down to a leaf
+	Steps []CriticalPathStep
+	// Bottleneck is the function of the path with the highest local response time
+	Bottleneck string
+	// EndToEndResponseTime is the end-to-end response time of the entry function, in seconds
+	EndToEndResponseTime float64
+}
+
+// criticalPaths follows, from every entry function, the slowest group of invocations of each function and the slowest
+// invocation within it, down to a leaf. Paths are sorted by entry function.
+func criticalPaths(nodes []FunctionNode, responseTimes map[string]float64, times graphTimes[float64]) []CriticalPath {
+	nodesByName := make(map[string]FunctionNode, len(nodes))
+	invoked := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		nodesByName[node.FunctionName] = node
+		for _, edge := range node.Invocations {
+			// A function only invoked asynchronously starts a path of its own
+			if edge.IsSync() {
+				invoked[edge.FunctionName] = true
+			}
+		}
+	}
+	entries := []string{}
+	for _, node := range nodes {
+		if !invoked[node.FunctionName] {
+			entries = append(entries, node.FunctionName)
+		}
+	}
+	sort.Strings(entries)
+
+	paths := make([]CriticalPath, 0, len(entries))
+	for _, entry := range entries {
+		path := CriticalPath{
+			Entry:                entry,
+			Steps:                []CriticalPathStep{{Function: entry, ResponseTime: responseTimes[entry]}},
+			Bottleneck:           entry,
+			EndToEndResponseTime: times.endToEnd[entry],
+		}
+		// The graph is acyclic, but a path can't be longer than the graph anyway
+		for node, ok := nodesByName[entry]; ok && len(path.Steps) <= len(nodes); {
+			next, found := slowestInvocation(node, times)
+			if !found {
+				break
+			}
+			step := CriticalPathStep{Function: next.FunctionName, EdgeId: &next.EdgeId, ResponseTime: responseTimes[next.FunctionName]}
+			path.Steps = append(path.Steps, step)
+			if step.ResponseTime > responseTimes[path.Bottleneck] {
+				path.Bottleneck = step.Function
+			}
+			node, ok = nodesByName[next.FunctionName]
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// slowestInvocation returns the slowest synchronous invocation of the slowest group of the node, the first one on ties.
+// It returns false if the caller does not wait for any invocation.
+func slowestInvocation(node FunctionNode, times graphTimes[float64]) (provisioningv1alpha1.InvocationEdge, bool) {
+	groups := times.edgeGroups[node.FunctionName]
+	edges := times.edges[node.FunctionName]
+
+	slowest := -1
+	for i, edge := range node.Invocations {
+		if !edge.IsSync() {
+			continue
+		}
+		if slowest < 0 {
+			slowest = i
+			continue
+		}
+		current := node.Invocations[slowest]
+		groupTime, slowestGroupTime := groups[edge.EdgeId], groups[current.EdgeId]
+		switch {
+		case groupTime > slowestGroupTime:
+			slowest = i
+		case groupTime == slowestGroupTime && edge.EdgeId == current.EdgeId && edges[i] > edges[slowest]:
+			slowest = i
+		case groupTime == slowestGroupTime && edge.EdgeId < current.EdgeId:
+			slowest = i
+		}
+	}
+	if slowest < 0 {
+		return provisioningv1alpha1.InvocationEdge{}, false
+	}
+	return node.Invocations[slowest], true
+}
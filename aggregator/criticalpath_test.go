@@ -0,0 +1,71 @@
+package aggregator
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	provisioningv1alpha1 "github.com/itspeetah/neptune-depdag-controller/api/v1alpha1"
+)
+
+var _ = Describe("Critical paths", func() {
+	nodes := sortNodesByDependencies([]FunctionNode{
+		{FunctionName: "A", Invocations: []provisioningv1alpha1.InvocationEdge{
+			{FunctionName: "B", EdgeId: 1, EdgeMultiplier: 1},
+			{FunctionName: "C", EdgeId: 1, EdgeMultiplier: 1},
+			{FunctionName: "D", EdgeId: 2, EdgeMultiplier: 1},
+		}},
+		{FunctionName: "B"},
+		{FunctionName: "C", Invocations: []provisioningv1alpha1.InvocationEdge{{FunctionName: "E", EdgeId: 1, EdgeMultiplier: 1}}},
+		{FunctionName: "D"},
+		{FunctionName: "E"},
+		{FunctionName: "F"},
+	})
+	functions := func(path CriticalPath) []string {
+		result := []string{}
+		for _, step := range path.Steps {
+			result = append(result, step.Function)
+		}
+		return result
+	}
+
+	It("should follow the slowest invocation of the slowest group from every entry function", func() {
+		responseTimes := map[string]float64{"A": 0.1, "B": 0.5, "C": 0.2, "D": 0.3, "E": 0.4, "F": 0.1}
+		paths := criticalPaths(nodes, responseTimes, aggregateEdgeGroups(nodes, responseTimes, nil, false))
+
+		Expect(paths).To(HaveLen(2))
+		Expect(paths[0].Entry).To(Equal("A"))
+		// C and E together are slower than B in the first group, which is slower than D
+		Expect(functions(paths[0])).To(Equal([]string{"A", "C", "E"}))
+		Expect(paths[0].Steps[0].EdgeId).To(BeNil())
+		Expect(*paths[0].Steps[1].EdgeId).To(Equal(int32(1)))
+		Expect(paths[0].Bottleneck).To(Equal("E"))
+		Expect(paths[0].EndToEndResponseTime).To(BeNumerically("~", 1.0, 1e-9))
+
+		Expect(functions(paths[1])).To(Equal([]string{"F"}))
+		Expect(paths[1].Bottleneck).To(Equal("F"))
+	})
+
+	It("should start a path from the functions that are only invoked asynchronously", func() {
+		nodes := sortNodesByDependencies([]FunctionNode{
+			{FunctionName: "A", Invocations: []provisioningv1alpha1.InvocationEdge{
+				{FunctionName: "B", EdgeId: 1, EdgeMultiplier: 1, Kind: provisioningv1alpha1.EdgeKindAsync},
+			}},
+			{FunctionName: "B"},
+		})
+		responseTimes := map[string]float64{"A": 0.1, "B": 0.5}
+		paths := criticalPaths(nodes, responseTimes, aggregateEdgeGroups(nodes, responseTimes, nil, false))
+
+		Expect(paths).To(HaveLen(2))
+		Expect(functions(paths[0])).To(Equal([]string{"A"}))
+		Expect(functions(paths[1])).To(Equal([]string{"B"}))
+	})
+
+	It("should move to another group when it becomes the slowest", func() {
+		responseTimes := map[string]float64{"A": 0.1, "B": 0.1, "C": 0.1, "D": 0.9, "E": 0.1}
+		paths := criticalPaths(nodes, responseTimes, aggregateEdgeGroups(nodes, responseTimes, nil, false))
+
+		Expect(functions(paths[0])).To(Equal([]string{"A", "D"}))
+		Expect(*paths[0].Steps[1].EdgeId).To(Equal(int32(2)))
+		Expect(paths[0].Bottleneck).To(Equal("D"))
+	})
+})
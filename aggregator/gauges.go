@@ -0,0 +1,228 @@
+package aggregator
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	functionResponseSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "depdag_function_response_seconds",
+		Help: "Measured response time of a function of a dependency graph",
+	}, []string{"graph", "graph_namespace", "namespace", "function"})
+	functionExternalResponseSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "depdag_function_external_response_seconds",
+		Help: "Time a function of a dependency graph spends waiting on the functions it invokes",
+	}, []string{"graph", "graph_namespace", "namespace", "function"})
+	functionEndToEndResponseSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "depdag_function_end_to_end_response_seconds",
+		Help: "Response time of a function of a dependency graph including the functions it invokes, recursively",
+	}, []string{"graph", "graph_namespace", "namespace", "function"})
+	functionRawResponseSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "depdag_function_raw_response_seconds",
+		Help: "Response time of a function of a dependency graph measured in the latest cycle, before smoothing",
+	}, []string{"graph", "graph_namespace", "namespace", "function"})
+	functionRawExternalResponseSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "depdag_function_raw_external_response_seconds",
+		Help: "External response time of a function of a dependency graph computed from the measurements of the latest cycle, before smoothing",
+	}, []string{"graph", "graph_namespace", "namespace", "function"})
+	functionRawEndToEndResponseSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "depdag_function_raw_end_to_end_response_seconds",
+		Help: "End-to-end response time of a function of a dependency graph computed from the measurements of the latest cycle, before smoothing",
+	}, []string{"graph", "graph_namespace", "namespace", "function"})
+	functionExpectedRequestsPerSecond = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "depdag_function_expected_requests_per_second",
+		Help: "Requests per second a function of a dependency graph should receive, propagated from the entry functions of the graph",
+	}, []string{"graph", "graph_namespace", "namespace", "function"})
+	functionResponseTimeTargetSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "depdag_function_response_time_target_seconds",
+		Help: "Response time a function of a dependency graph should meet, its share of the response time SLOs of the graph",
+	}, []string{"graph", "graph_namespace", "namespace", "function"})
+	functionEndToEndBudgetSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "depdag_function_end_to_end_budget_seconds",
+		Help: "Share of the response time SLOs of a dependency graph for a function and the functions it waits for",
+	}, []string{"graph", "graph_namespace", "namespace", "function"})
+	edgeGroupSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "depdag_edge_group_seconds",
+		Help: "Aggregated time of a group of invocations performed by a function of a dependency graph",
+	}, []string{"graph", "graph_namespace", "namespace", "function", "edge_id"})
+	criticalPathSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "depdag_critical_path_seconds",
+		Help: "End-to-end response time of an entry function of a dependency graph, labeled with its critical path " +
+			"(the functions from the entry one down to a leaf, separated by >) and the function of the path with the highest local response time",
+	}, []string{"graph", "graph_namespace", "entry", "path", "bottleneck"})
+	aggregationTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "depdag_aggregation_timeouts_total",
+		Help: "Number of aggregation cycles of a dependency graph that ran out of time",
+	}, []string{"graph", "graph_namespace"})
+)
+
+func init() {
+	// Served by the manager metrics endpoint (--metrics-bind-address)
+	metrics.Registry.MustRegister(functionResponseSeconds, functionExternalResponseSeconds, functionEndToEndResponseSeconds, edgeGroupSeconds,
+		functionRawResponseSeconds, functionRawExternalResponseSeconds, functionRawEndToEndResponseSeconds,
+		functionExpectedRequestsPerSecond, functionResponseTimeTargetSeconds, functionEndToEndBudgetSeconds,
+		criticalPathSeconds, aggregationTimeouts)
+}
+
+// GaugePublisher exposes the times computed for every graph as prometheus gauges.
+type GaugePublisher struct {
+	lock sync.Mutex
+	// Series currently set for each graph, so that the ones of removed nodes and edges can be deleted
+	functionSeries     map[types.NamespacedName][]prometheus.Labels
+	edgeGroupSeries    map[types.NamespacedName][]prometheus.Labels
+	budgetSeries       map[types.NamespacedName][]prometheus.Labels
+	requestRateSeries  map[types.NamespacedName][]prometheus.Labels
+	criticalPathSeries map[types.NamespacedName][]prometheus.Labels
+}
+
+func NewGaugePublisher() *GaugePublisher {
+	return &GaugePublisher{
+		functionSeries:     make(map[types.NamespacedName][]prometheus.Labels),
+		edgeGroupSeries:    make(map[types.NamespacedName][]prometheus.Labels),
+		budgetSeries:       make(map[types.NamespacedName][]prometheus.Labels),
+		requestRateSeries:  make(map[types.NamespacedName][]prometheus.Labels),
+		criticalPathSeries: make(map[types.NamespacedName][]prometheus.Labels),
+	}
+}
+
+func (p *GaugePublisher) Publish(ctx context.Context, result *Result) error {
+	if result.TimedOut {
+		// Keep the times of the last complete cycle
+		return nil
+	}
+
+	functionSeries := []prometheus.Labels{}
+	edgeGroupSeries := []prometheus.Labels{}
+	budgetSeries := []prometheus.Labels{}
+	requestRateSeries := []prometheus.Labels{}
+	for _, function := range result.Functions {
+		// The namespace label is the one of the function, which can differ from the one of the graph
+		labels := prometheus.Labels{
+			"graph":           result.Graph.Name,
+			"graph_namespace": result.Graph.Namespace,
+			"namespace":       function.Namespace,
+			"function":        function.Name,
+		}
+		// A function without measurements would look like a fast one, its series go away instead
+		if function.Measured {
+			functionResponseSeconds.With(labels).Set(function.ResponseTime)
+			functionExternalResponseSeconds.With(labels).Set(function.ExternalResponseTime)
+			functionEndToEndResponseSeconds.With(labels).Set(function.EndToEndResponseTime)
+			functionRawResponseSeconds.With(labels).Set(function.Raw.ResponseTime)
+			functionRawExternalResponseSeconds.With(labels).Set(function.Raw.ExternalResponseTime)
+			functionRawEndToEndResponseSeconds.With(labels).Set(function.Raw.EndToEndResponseTime)
+			functionSeries = append(functionSeries, labels)
+		}
+		if function.RequestRateKnown {
+			functionExpectedRequestsPerSecond.With(labels).Set(function.ExpectedRequestRate)
+			requestRateSeries = append(requestRateSeries, labels)
+		}
+		if function.Budget != nil {
+			functionResponseTimeTargetSeconds.With(labels).Set(function.Budget.ResponseTime)
+			functionEndToEndBudgetSeconds.With(labels).Set(function.Budget.EndToEnd)
+			budgetSeries = append(budgetSeries, labels)
+		}
+
+		for edgeId, edgeGroupTime := range function.EdgeGroups {
+			edgeLabels := prometheus.Labels{
+				"graph":           result.Graph.Name,
+				"graph_namespace": result.Graph.Namespace,
+				"namespace":       function.Namespace,
+				"function":        function.Name,
+				"edge_id":         strconv.Itoa(int(edgeId)),
+			}
+			edgeGroupSeconds.With(edgeLabels).Set(edgeGroupTime)
+			edgeGroupSeries = append(edgeGroupSeries, edgeLabels)
+		}
+	}
+
+	criticalPathSeries := []prometheus.Labels{}
+	for _, path := range result.CriticalPaths {
+		functions := make([]string, 0, len(path.Steps))
+		for _, step := range path.Steps {
+			functions = append(functions, step.Function)
+		}
+		labels := prometheus.Labels{
+			"graph":           result.Graph.Name,
+			"graph_namespace": result.Graph.Namespace,
+			"entry":           path.Entry,
+			"path":            strings.Join(functions, ">"),
+			"bottleneck":      path.Bottleneck,
+		}
+		criticalPathSeconds.With(labels).Set(path.EndToEndResponseTime)
+		criticalPathSeries = append(criticalPathSeries, labels)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	deleteStaleSeries(p.functionSeries[result.Graph], functionSeries,
+		functionResponseSeconds, functionExternalResponseSeconds, functionEndToEndResponseSeconds,
+		functionRawResponseSeconds, functionRawExternalResponseSeconds, functionRawEndToEndResponseSeconds)
+	deleteStaleSeries(p.edgeGroupSeries[result.Graph], edgeGroupSeries, edgeGroupSeconds)
+	deleteStaleSeries(p.requestRateSeries[result.Graph], requestRateSeries, functionExpectedRequestsPerSecond)
+	deleteStaleSeries(p.budgetSeries[result.Graph], budgetSeries, functionResponseTimeTargetSeconds, functionEndToEndBudgetSeconds)
+	deleteStaleSeries(p.criticalPathSeries[result.Graph], criticalPathSeries, criticalPathSeconds)
+	p.functionSeries[result.Graph] = functionSeries
+	p.edgeGroupSeries[result.Graph] = edgeGroupSeries
+	p.budgetSeries[result.Graph] = budgetSeries
+	p.requestRateSeries[result.Graph] = requestRateSeries
+	p.criticalPathSeries[result.Graph] = criticalPathSeries
+	return nil
+}
+
+func (p *GaugePublisher) Retract(ctx context.Context, graph types.NamespacedName) error {
+	aggregationTimeouts.DeleteLabelValues(graph.Name, graph.Namespace)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	deleteStaleSeries(p.functionSeries[graph], nil,
+		functionResponseSeconds, functionExternalResponseSeconds, functionEndToEndResponseSeconds,
+		functionRawResponseSeconds, functionRawExternalResponseSeconds, functionRawEndToEndResponseSeconds)
+	deleteStaleSeries(p.edgeGroupSeries[graph], nil, edgeGroupSeconds)
+	deleteStaleSeries(p.requestRateSeries[graph], nil, functionExpectedRequestsPerSecond)
+	deleteStaleSeries(p.budgetSeries[graph], nil, functionResponseTimeTargetSeconds, functionEndToEndBudgetSeconds)
+	deleteStaleSeries(p.criticalPathSeries[graph], nil, criticalPathSeconds)
+	delete(p.functionSeries, graph)
+	delete(p.edgeGroupSeries, graph)
+	delete(p.budgetSeries, graph)
+	delete(p.requestRateSeries, graph)
+	delete(p.criticalPathSeries, graph)
+	return nil
+}
+
+// deleteStaleSeries removes from the gauges the series that were published before but are not anymore
+func deleteStaleSeries(previous []prometheus.Labels, current []prometheus.Labels, gauges ...*prometheus.GaugeVec) {
+	for _, old := range previous {
+		stale := true
+		for _, labels := range current {
+			if equalLabels(old, labels) {
+				stale = false
+				break
+			}
+		}
+		if stale {
+			for _, gauge := range gauges {
+				gauge.Delete(old)
+			}
+		}
+	}
+}
+
+func equalLabels(a, b prometheus.Labels) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		if b[name] != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,128 @@
+package aggregator
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var _ = Describe("GaugePublisher", func() {
+	ctx := context.Background()
+	graph := types.NamespacedName{Namespace: "gauges", Name: "graph"}
+
+	It("should set the gauges of every function and edge group and drop the ones that disappear", func() {
+		publisher := NewGaugePublisher()
+
+		Expect(publisher.Publish(ctx, &Result{
+			Graph:     graph,
+			Timestamp: time.Now(),
+			Functions: map[string]FunctionTimes{
+				"A": {
+					Name: "A", Namespace: "fn", Measured: true, ResponseTime: 0.1, ExternalResponseTime: 0.3, EndToEndResponseTime: 0.4, EdgeGroups: map[int32]float64{1: 0.2, 2: 0.1},
+					Raw:                 RawTimes{ResponseTime: 0.2, ExternalResponseTime: 0.5, EndToEndResponseTime: 0.7},
+					ExpectedRequestRate: 12.5,
+					RequestRateKnown:    true,
+					Budget:              &Budget{EndToEnd: 0.3, ResponseTime: 0.08},
+				},
+				"B": {Name: "B", Namespace: "fn", Measured: true, ResponseTime: 0.2},
+			},
+			CriticalPaths: []CriticalPath{{Entry: "A", Steps: []CriticalPathStep{{Function: "A"}, {Function: "B"}}, Bottleneck: "B", EndToEndResponseTime: 0.4}},
+		})).To(Succeed())
+
+		Expect(testutil.ToFloat64(functionResponseSeconds.WithLabelValues("graph", "gauges", "fn", "A"))).To(BeNumerically("~", 0.1))
+		Expect(testutil.ToFloat64(functionExternalResponseSeconds.WithLabelValues("graph", "gauges", "fn", "A"))).To(BeNumerically("~", 0.3))
+		Expect(testutil.ToFloat64(functionEndToEndResponseSeconds.WithLabelValues("graph", "gauges", "fn", "A"))).To(BeNumerically("~", 0.4))
+		Expect(testutil.ToFloat64(edgeGroupSeconds.WithLabelValues("graph", "gauges", "fn", "A", "2"))).To(BeNumerically("~", 0.1))
+		Expect(testutil.ToFloat64(functionRawResponseSeconds.WithLabelValues("graph", "gauges", "fn", "A"))).To(BeNumerically("~", 0.2))
+		Expect(testutil.ToFloat64(functionExpectedRequestsPerSecond.WithLabelValues("graph", "gauges", "fn", "A"))).To(BeNumerically("~", 12.5))
+		Expect(testutil.ToFloat64(functionResponseTimeTargetSeconds.WithLabelValues("graph", "gauges", "fn", "A"))).To(BeNumerically("~", 0.08))
+		Expect(testutil.ToFloat64(functionEndToEndBudgetSeconds.WithLabelValues("graph", "gauges", "fn", "A"))).To(BeNumerically("~", 0.3))
+		Expect(functionResponseTimeTargetSeconds.DeleteLabelValues("graph", "gauges", "fn", "B")).To(BeFalse())
+		Expect(functionExpectedRequestsPerSecond.DeleteLabelValues("graph", "gauges", "fn", "B")).To(BeFalse())
+		Expect(testutil.ToFloat64(criticalPathSeconds.WithLabelValues("graph", "gauges", "A", "A>B", "B"))).To(BeNumerically("~", 0.4))
+		Expect(testutil.ToFloat64(functionRawExternalResponseSeconds.WithLabelValues("graph", "gauges", "fn", "A"))).To(BeNumerically("~", 0.5))
+		Expect(testutil.ToFloat64(functionRawEndToEndResponseSeconds.WithLabelValues("graph", "gauges", "fn", "A"))).To(BeNumerically("~", 0.7))
+
+		Expect(publisher.Publish(ctx, &Result{
+			Graph:     graph,
+			Timestamp: time.Now(),
+			Functions: map[string]FunctionTimes{
+				"A": {Name: "A", Namespace: "fn", Measured: true, ResponseTime: 0.15, ExternalResponseTime: 0.2, EdgeGroups: map[int32]float64{1: 0.2}},
+			},
+		})).To(Succeed())
+
+		Expect(testutil.ToFloat64(functionResponseSeconds.WithLabelValues("graph", "gauges", "fn", "A"))).To(BeNumerically("~", 0.15))
+		Expect(functionResponseSeconds.Delete(map[string]string{"graph": "graph", "graph_namespace": "gauges", "namespace": "fn", "function": "B"})).To(BeFalse())
+		Expect(functionRawResponseSeconds.Delete(map[string]string{"graph": "graph", "graph_namespace": "gauges", "namespace": "fn", "function": "B"})).To(BeFalse())
+		Expect(criticalPathSeconds.DeleteLabelValues("graph", "gauges", "A", "A>B", "B")).To(BeFalse())
+		// A is no longer under an SLO, and its request rate is no longer known
+		Expect(functionResponseTimeTargetSeconds.DeleteLabelValues("graph", "gauges", "fn", "A")).To(BeFalse())
+		Expect(functionExpectedRequestsPerSecond.DeleteLabelValues("graph", "gauges", "fn", "A")).To(BeFalse())
+		Expect(edgeGroupSeconds.Delete(map[string]string{"graph": "graph", "graph_namespace": "gauges", "namespace": "fn", "function": "A", "edge_id": "2"})).To(BeFalse())
+	})
+
+	It("should drop the time series of the functions that are not measured", func() {
+		publisher := NewGaugePublisher()
+		unmeasured := types.NamespacedName{Namespace: "gauges", Name: "unmeasured"}
+
+		Expect(publisher.Publish(ctx, &Result{
+			Graph:     unmeasured,
+			Timestamp: time.Now(),
+			Functions: map[string]FunctionTimes{
+				"A": {Name: "A", Namespace: "fn", Measured: true, ResponseTime: 0.1},
+				"B": {Name: "B", Namespace: "fn"},
+			},
+		})).To(Succeed())
+		Expect(testutil.ToFloat64(functionResponseSeconds.WithLabelValues("unmeasured", "gauges", "fn", "A"))).To(BeNumerically("~", 0.1))
+		Expect(functionResponseSeconds.DeleteLabelValues("unmeasured", "gauges", "fn", "B")).To(BeFalse())
+
+		Expect(publisher.Publish(ctx, &Result{
+			Graph:     unmeasured,
+			Timestamp: time.Now(),
+			Functions: map[string]FunctionTimes{
+				"A": {Name: "A", Namespace: "fn"},
+				"B": {Name: "B", Namespace: "fn"},
+			},
+		})).To(Succeed())
+		Expect(functionResponseSeconds.DeleteLabelValues("unmeasured", "gauges", "fn", "A")).To(BeFalse())
+		Expect(functionEndToEndResponseSeconds.DeleteLabelValues("unmeasured", "gauges", "fn", "A")).To(BeFalse())
+	})
+
+	It("should drop every time series of a graph whose percentile cannot be computed", func() {
+		publisher := NewGaugePublisher()
+		unsupported := types.NamespacedName{Namespace: "gauges", Name: "unsupported"}
+
+		Expect(publisher.Publish(ctx, &Result{
+			Graph:     unsupported,
+			Timestamp: time.Now(),
+			Functions: map[string]FunctionTimes{
+				"A": {Name: "A", Namespace: "fn", Measured: true, ResponseTime: 0.1, EdgeGroups: map[int32]float64{1: 0.2}},
+			},
+		})).To(Succeed())
+		Expect(publisher.Publish(ctx, &Result{Graph: unsupported, Timestamp: time.Now(), PercentileUnsupported: true})).To(Succeed())
+
+		Expect(functionResponseSeconds.DeleteLabelValues("unsupported", "gauges", "fn", "A")).To(BeFalse())
+		Expect(edgeGroupSeconds.Delete(map[string]string{"graph": "unsupported", "graph_namespace": "gauges", "namespace": "fn", "function": "A", "edge_id": "1"})).To(BeFalse())
+	})
+
+	It("should delete every series of a graph when it is retracted", func() {
+		publisher := NewGaugePublisher()
+		retracted := types.NamespacedName{Namespace: "gauges", Name: "retracted"}
+
+		Expect(publisher.Publish(ctx, &Result{
+			Graph:     retracted,
+			Timestamp: time.Now(),
+			Functions: map[string]FunctionTimes{
+				"A": {Name: "A", Namespace: "fn", Measured: true, ResponseTime: 0.1, EdgeGroups: map[int32]float64{1: 0.2}},
+			},
+		})).To(Succeed())
+		Expect(publisher.Retract(ctx, retracted)).To(Succeed())
+
+		Expect(functionResponseSeconds.Delete(map[string]string{"graph": "retracted", "graph_namespace": "gauges", "namespace": "fn", "function": "A"})).To(BeFalse())
+		Expect(edgeGroupSeconds.Delete(map[string]string{"graph": "retracted", "graph_namespace": "gauges", "namespace": "fn", "function": "A", "edge_id": "1"})).To(BeFalse())
+	})
+})
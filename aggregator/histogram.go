@@ -0,0 +1,250 @@
+package aggregator
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Resolution of the histograms: a bucket is spread over a few points, and the results of the operations on histograms
+// are merged down to a bounded number of points, so that convolutions along deep graphs stay cheap
+const (
+	histogramPointsPerBucket = 4
+	maxHistogramPoints       = 256
+)
+
+// HistogramBucket is a bucket of a cumulative latency histogram, as exported by Prometheus
+type HistogramBucket struct {
+	// UpperBound of the bucket in seconds, +Inf for the last one
+	UpperBound float64
+	// Count of the observations less than or equal to the upper bound (or their rate)
+	Count float64
+}
+
+// histogramPoint is a response time, in seconds, with its probability
+type histogramPoint struct {
+	value       float64
+	probability float64
+}
+
+// Histogram is the distribution of a response time.
+// It is a discrete approximation, sorted by value and with probabilities that add up to 1.
+type Histogram struct {
+	points []histogramPoint
+}
+
+// NewHistogram builds the distribution of the observations of a cumulative histogram.
+// The observations are spread evenly within each bucket, the first one starting at 0, and the ones in the +Inf bucket
+// are placed at the highest finite upper bound, like histogram_quantile does.
+func NewHistogram(buckets []HistogramBucket) (*Histogram, error) {
+	buckets = append([]HistogramBucket{}, buckets...)
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].UpperBound < buckets[j].UpperBound })
+
+	points := []histogramPoint{}
+	lowerBound, previousCount := 0.0, 0.0
+	for _, bucket := range buckets {
+		if math.IsNaN(bucket.Count) {
+			continue
+		}
+		// Rates of the buckets are computed independently, so they are not always exactly cumulative
+		count := bucket.Count - previousCount
+		previousCount = max(previousCount, bucket.Count)
+		if math.IsInf(bucket.UpperBound, 1) {
+			if count > 0 {
+				points = append(points, histogramPoint{value: lowerBound, probability: count})
+			}
+			continue
+		}
+		if count > 0 {
+			width := (bucket.UpperBound - lowerBound) / histogramPointsPerBucket
+			for i := range histogramPointsPerBucket {
+				points = append(points, histogramPoint{
+					value:       lowerBound + (float64(i)+0.5)*width,
+					probability: count / histogramPointsPerBucket,
+				})
+			}
+		}
+		lowerBound = bucket.UpperBound
+	}
+
+	total := 0.0
+	for _, point := range points {
+		total += point.probability
+	}
+	if total <= 0 {
+		return nil, fmt.Errorf("%w: the histogram has no observations", ErrNoMetrics)
+	}
+	for i := range points {
+		points[i].probability /= total
+	}
+	return newHistogram(points), nil
+}
+
+// pointHistogram is the distribution of a response time that is always the same
+func pointHistogram(value float64) *Histogram {
+	return &Histogram{points: []histogramPoint{{value: value, probability: 1}}}
+}
+
+// newHistogram sorts the points, merges the ones with the same value and bins them if they are too many
+func newHistogram(points []histogramPoint) *Histogram {
+	sort.Slice(points, func(i, j int) bool { return points[i].value < points[j].value })
+	merged := make([]histogramPoint, 0, len(points))
+	for _, point := range points {
+		if n := len(merged); n > 0 && merged[n-1].value == point.value {
+			merged[n-1].probability += point.probability
+		} else {
+			merged = append(merged, point)
+		}
+	}
+	if len(merged) <= maxHistogramPoints {
+		return &Histogram{points: merged}
+	}
+
+	// Bins of the same width, each one represented by the mean of its points
+	lowest, highest := merged[0].value, merged[len(merged)-1].value
+	width := (highest - lowest) / maxHistogramPoints
+	bins := make([]histogramPoint, maxHistogramPoints)
+	for _, point := range merged {
+		bin := min(int((point.value-lowest)/width), maxHistogramPoints-1)
+		bins[bin].value += point.value * point.probability
+		bins[bin].probability += point.probability
+	}
+	binned := make([]histogramPoint, 0, maxHistogramPoints)
+	for _, bin := range bins {
+		if bin.probability > 0 {
+			binned = append(binned, histogramPoint{value: bin.value / bin.probability, probability: bin.probability})
+		}
+	}
+	return &Histogram{points: binned}
+}
+
+// Quantile returns the response time below which the given fraction (in [0, 1]) of the requests falls,
+// interpolating linearly between the points of the histogram.
+func (h *Histogram) Quantile(quantile float64) float64 {
+	cumulative := 0.0
+	for i, point := range h.points {
+		previous := cumulative
+		cumulative += point.probability
+		if cumulative < quantile {
+			continue
+		}
+		if i == 0 {
+			return point.value
+		}
+		return h.points[i-1].value + (point.value-h.points[i-1].value)*(quantile-previous)/point.probability
+	}
+	return h.points[len(h.points)-1].value
+}
+
+// below returns the distribution of the times up to the threshold, nil if there are none, and the probability of the others
+func (h *Histogram) below(threshold float64) (*Histogram, float64) {
+	points := []histogramPoint{}
+	probability := 0.0
+	for _, point := range h.points {
+		if point.value <= threshold {
+			points = append(points, point)
+			probability += point.probability
+		}
+	}
+	if probability == 0 {
+		return nil, 1
+	}
+	for i := range points {
+		points[i].probability /= probability
+	}
+	return &Histogram{points: points}, 1 - probability
+}
+
+// capped returns the distribution of the times cut at the threshold
+func (h *Histogram) capped(threshold float64) *Histogram {
+	points := make([]histogramPoint, 0, len(h.points))
+	for _, point := range h.points {
+		points = append(points, histogramPoint{value: min(point.value, threshold), probability: point.probability})
+	}
+	return newHistogram(points)
+}
+
+// Add returns the distribution of the sum of two independent response times, as in sequential invocations
+func (h *Histogram) Add(other *Histogram) *Histogram {
+	points := make([]histogramPoint, 0, len(h.points)*len(other.points))
+	for _, a := range h.points {
+		for _, b := range other.points {
+			points = append(points, histogramPoint{value: a.value + b.value, probability: a.probability * b.probability})
+		}
+	}
+	return newHistogram(points)
+}
+
+// Max returns the distribution of the slower of two independent response times, as in parallel invocations
+func (h *Histogram) Max(other *Histogram) *Histogram {
+	// The cumulative distribution of the maximum is the product of the cumulative distributions
+	points := make([]histogramPoint, 0, len(h.points)+len(other.points))
+	i, j := 0, 0
+	cumulativeA, cumulativeB, previous := 0.0, 0.0, 0.0
+	for i < len(h.points) || j < len(other.points) {
+		var value float64
+		switch {
+		case j == len(other.points) || (i < len(h.points) && h.points[i].value < other.points[j].value):
+			value = h.points[i].value
+		default:
+			value = other.points[j].value
+		}
+		for i < len(h.points) && h.points[i].value == value {
+			cumulativeA += h.points[i].probability
+			i++
+		}
+		for j < len(other.points) && other.points[j].value == value {
+			cumulativeB += other.points[j].probability
+			j++
+		}
+		cumulative := cumulativeA * cumulativeB
+		if cumulative > previous {
+			points = append(points, histogramPoint{value: value, probability: cumulative - previous})
+			previous = cumulative
+		}
+	}
+	return newHistogram(points)
+}
+
+// Times returns the distribution of the total time of n independent invocations in sequence
+func (h *Histogram) Times(n int32) *Histogram {
+	if n <= 0 {
+		return pointHistogram(0)
+	}
+	if n == 1 {
+		return h
+	}
+	// Exponentiation by squaring, so that large multipliers take a few convolutions
+	var result *Histogram
+	power := h
+	for ; n > 0; n >>= 1 {
+		if n&1 == 1 {
+			if result == nil {
+				result = power
+			} else {
+				result = result.Add(power)
+			}
+		}
+		if n > 1 {
+			power = power.Add(power)
+		}
+	}
+	return result
+}
+
+// mixHistograms returns the distribution of a time that follows each of the histograms with the given probability
+func mixHistograms(histograms []*Histogram, weights []float64) *Histogram {
+	if len(histograms) == 1 {
+		return histograms[0]
+	}
+	points := []histogramPoint{}
+	for i, histogram := range histograms {
+		if weights[i] == 0 {
+			continue
+		}
+		for _, point := range histogram.points {
+			points = append(points, histogramPoint{value: point.value, probability: point.probability * weights[i]})
+		}
+	}
+	return newHistogram(points)
+}
@@ -0,0 +1,70 @@
+package aggregator
+
+import (
+	"math"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Histogram", func() {
+	// twoValues is a response time that is either 1 or 2 seconds
+	twoValues := func() *Histogram {
+		return &Histogram{points: []histogramPoint{{value: 1, probability: 0.5}, {value: 2, probability: 0.5}}}
+	}
+
+	It("should spread the observations of each bucket", func() {
+		histogram, err := NewHistogram([]HistogramBucket{
+			{UpperBound: math.Inf(1), Count: 100},
+			{UpperBound: 0.1, Count: 50},
+			{UpperBound: 0.2, Count: 100},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(histogram.points).To(HaveLen(8))
+		Expect(histogram.Quantile(0.25)).To(BeNumerically("~", 0.05, 0.02))
+		Expect(histogram.Quantile(0.75)).To(BeNumerically("~", 0.15, 0.02))
+		Expect(histogram.Quantile(1)).To(BeNumerically("~", 0.1875, 1e-9))
+	})
+
+	It("should place the observations of the +Inf bucket at the highest finite bound", func() {
+		histogram, err := NewHistogram([]HistogramBucket{{UpperBound: 0.5, Count: 1}, {UpperBound: math.Inf(1), Count: 2}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(histogram.Quantile(0.99)).To(BeNumerically("~", 0.5, 0.01))
+		Expect(histogram.Quantile(1)).To(Equal(0.5))
+	})
+
+	It("should report histograms without observations", func() {
+		_, err := NewHistogram([]HistogramBucket{{UpperBound: 0.5, Count: 0}, {UpperBound: math.Inf(1), Count: math.NaN()}})
+		Expect(err).To(MatchError(ErrNoMetrics))
+	})
+
+	It("should add independent times", func() {
+		Expect(twoValues().Add(pointHistogram(1)).points).To(Equal([]histogramPoint{{value: 2, probability: 0.5}, {value: 3, probability: 0.5}}))
+		Expect(twoValues().Times(3).points).To(Equal([]histogramPoint{
+			{value: 3, probability: 0.125}, {value: 4, probability: 0.375}, {value: 5, probability: 0.375}, {value: 6, probability: 0.125},
+		}))
+		Expect(twoValues().Times(1)).To(Equal(twoValues()))
+	})
+
+	It("should take the slower of independent times", func() {
+		Expect(twoValues().Max(twoValues()).points).To(Equal([]histogramPoint{{value: 1, probability: 0.25}, {value: 2, probability: 0.75}}))
+		Expect(twoValues().Max(pointHistogram(1.5)).points).To(Equal([]histogramPoint{{value: 1.5, probability: 0.5}, {value: 2, probability: 0.5}}))
+	})
+
+	It("should keep a bounded number of points", func() {
+		points := []histogramPoint{}
+		for i := range 200 {
+			points = append(points, histogramPoint{value: float64(i), probability: 1.0 / 200})
+		}
+		histogram := newHistogram(points)
+		sum := histogram.Add(histogram)
+		Expect(len(sum.points)).To(BeNumerically("<=", maxHistogramPoints))
+
+		total := 0.0
+		for _, point := range sum.points {
+			total += point.probability
+		}
+		Expect(total).To(BeNumerically("~", 1, 1e-9))
+		Expect(sum.Quantile(0.5)).To(BeNumerically("~", 199, 2))
+	})
+})
@@ -0,0 +1,249 @@
+package aggregator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ServiceLevelAgreementGVK is the kind of the Kosmos resource holding the response time target of a function.
+// The Kosmos types are not imported, the objects are handled as unstructured ones.
+var ServiceLevelAgreementGVK = schema.GroupVersionKind{
+	Group:   "systemautoscaler.polimi.it",
+	Version: "v1beta1",
+	Kind:    "ServiceLevelAgreement",
+}
+
+// Annotations and labels written on the service level agreements of the functions of a graph
+const (
+	// KosmosOriginalResponseTimeAnnotation is the response time target set on the agreement before the publisher replaced
+	// it, restored once the function leaves the graph
+	KosmosOriginalResponseTimeAnnotation = "provisioning.pgmp.me/original-response-time"
+	// KosmosPublishedResponseTimeAnnotation is the response time target written by the publisher, which tells whether
+	// the target was changed by someone else since then
+	KosmosPublishedResponseTimeAnnotation = "provisioning.pgmp.me/published-response-time"
+	// KosmosExternalResponseTimeAnnotation is the time the function waits on the functions it invokes, as a Go duration,
+	// subtracted from the original target
+	KosmosExternalResponseTimeAnnotation = "provisioning.pgmp.me/external-response-time"
+	// KosmosEndToEndResponseTimeAnnotation is the end-to-end response time of the function, as a Go duration
+	KosmosEndToEndResponseTimeAnnotation = "provisioning.pgmp.me/end-to-end-response-time"
+	// KosmosResponseTimeTargetAnnotation is the share of the SLOs of the graph for the function, if any SLO depends on it
+	KosmosResponseTimeTargetAnnotation = "provisioning.pgmp.me/response-time-target"
+	// KosmosGraphLabel and KosmosGraphNamespaceLabel identify the graph that wrote the annotations
+	KosmosGraphLabel          = "provisioning.pgmp.me/graph"
+	KosmosGraphNamespaceLabel = "provisioning.pgmp.me/graph-namespace"
+)
+
+// DefaultKosmosResponseTimeUnit is the unit of the response time targets of the Kosmos agreements
+const DefaultKosmosResponseTimeUnit = time.Millisecond
+
+// KosmosPublisher subtracts the external response time computed in every cycle from the response time target of the
+// Kosmos service level agreements of the functions, the ones whose spec.service.name is the function name, so that
+// the recommender sizes every function for the time it spends itself. The target set on the agreement is kept in an
+// annotation, and restored when the function leaves the graph or the graph is deleted; if the target is changed while
+// the publisher manages it, the new one is used from then on. The times are also written as annotations, for reference.
+// An agreement should only select functions of one graph, otherwise the graphs overwrite each other's times.
+// The agreements are only patched when a value changes, and are read through the cache of the client if it caches
+// unstructured objects, so that the publisher does not query the API server on every cycle.
+type KosmosPublisher struct {
+	client client.Client
+	// responseTimeUnit is the unit of spec.metric.responseTime in the agreements
+	responseTimeUnit time.Duration
+}
+
+func NewKosmosPublisher(client client.Client, responseTimeUnit time.Duration) *KosmosPublisher {
+	return &KosmosPublisher{client: client, responseTimeUnit: responseTimeUnit}
+}
+
+func (p *KosmosPublisher) Publish(ctx context.Context, result *Result) error {
+	if result.TimedOut {
+		// Keep the times of the last complete cycle
+		return nil
+	}
+
+	functionsByNamespace := make(map[string]map[string]FunctionTimes)
+	for _, function := range result.Functions {
+		if functionsByNamespace[function.Namespace] == nil {
+			functionsByNamespace[function.Namespace] = make(map[string]FunctionTimes)
+		}
+		functionsByNamespace[function.Namespace][function.Name] = function
+	}
+
+	var errs []error
+	published := make(map[types.NamespacedName]bool)
+	for namespace, functions := range functionsByNamespace {
+		agreements := newServiceLevelAgreementList()
+		if err := p.client.List(ctx, agreements, client.InNamespace(namespace)); meta.IsNoMatchError(err) {
+			klog.V(2).InfoS("Kosmos is not installed, not publishing the graph times on its agreements", "graph", result.Graph)
+			return nil
+		} else if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for i := range agreements.Items {
+			agreement := &agreements.Items[i]
+			serviceName, _, _ := unstructured.NestedString(agreement.Object, "spec", "service", "name")
+			function, ok := functions[serviceName]
+			if !ok {
+				continue
+			}
+			published[client.ObjectKeyFromObject(agreement)] = true
+			errs = append(errs, p.patch(ctx, agreement, func(agreement *unstructured.Unstructured) error {
+				return p.setKosmosTimes(agreement, result.Graph, &function)
+			}))
+		}
+	}
+
+	// Agreements of the functions that left the graph, or that no longer select one of its functions
+	previous, err := p.graphAgreements(ctx, result.Graph)
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		for i := range previous.Items {
+			if !published[client.ObjectKeyFromObject(&previous.Items[i])] {
+				errs = append(errs, p.patch(ctx, &previous.Items[i], func(agreement *unstructured.Unstructured) error {
+					return p.setKosmosTimes(agreement, result.Graph, nil)
+				}))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Retract restores the targets of every agreement of the graph and removes its times, if Kosmos is installed at all
+func (p *KosmosPublisher) Retract(ctx context.Context, graph types.NamespacedName) error {
+	agreements, err := p.graphAgreements(ctx, graph)
+	if meta.IsNoMatchError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for i := range agreements.Items {
+		errs = append(errs, p.patch(ctx, &agreements.Items[i], func(agreement *unstructured.Unstructured) error {
+			return p.setKosmosTimes(agreement, graph, nil)
+		}))
+	}
+	return errors.Join(errs...)
+}
+
+// graphAgreements returns the agreements the graph wrote its times on, in any namespace
+func (p *KosmosPublisher) graphAgreements(ctx context.Context, graph types.NamespacedName) (*unstructured.UnstructuredList, error) {
+	agreements := newServiceLevelAgreementList()
+	err := p.client.List(ctx, agreements, client.MatchingLabels{
+		KosmosGraphLabel:          graph.Name,
+		KosmosGraphNamespaceLabel: graph.Namespace,
+	})
+	return agreements, err
+}
+
+// patch applies the change to the agreement, if it changes anything.
+// Agreements deleted in the meantime are skipped.
+func (p *KosmosPublisher) patch(ctx context.Context, agreement *unstructured.Unstructured, change func(*unstructured.Unstructured) error) error {
+	original := agreement.DeepCopy()
+	if err := change(agreement); err != nil {
+		return err
+	}
+	if equality.Semantic.DeepEqual(original.Object, agreement.Object) {
+		return nil
+	}
+	return client.IgnoreNotFound(p.client.Patch(ctx, agreement, client.MergeFrom(original)))
+}
+
+// setKosmosTimes writes the target of the function on the agreement, or restores the original one if function is nil
+func (p *KosmosPublisher) setKosmosTimes(agreement *unstructured.Unstructured, graph types.NamespacedName, function *FunctionTimes) error {
+	annotations := agreement.GetAnnotations()
+	labels := agreement.GetLabels()
+
+	// The original target is put back, unless it was replaced since the publisher last wrote it
+	if original, ok := annotations[KosmosOriginalResponseTimeAnnotation]; ok {
+		current, err := responseTimeTarget(agreement)
+		published, publishedErr := resource.ParseQuantity(annotations[KosmosPublishedResponseTimeAnnotation])
+		if err == nil && publishedErr == nil && current.Cmp(published) == 0 {
+			if err := unstructured.SetNestedField(agreement.Object, original, "spec", "metric", "responseTime"); err != nil {
+				return err
+			}
+		}
+	}
+	for _, key := range []string{
+		KosmosOriginalResponseTimeAnnotation, KosmosPublishedResponseTimeAnnotation,
+		KosmosExternalResponseTimeAnnotation, KosmosEndToEndResponseTimeAnnotation, KosmosResponseTimeTargetAnnotation,
+	} {
+		delete(annotations, key)
+	}
+	delete(labels, KosmosGraphLabel)
+	delete(labels, KosmosGraphNamespaceLabel)
+
+	if function != nil {
+		original, err := responseTimeTarget(agreement)
+		if err != nil {
+			return err
+		}
+		// The function has to meet what is left of the target once the functions it invokes have answered,
+		// and at least the smallest target that can be written
+		unit := p.responseTimeUnit.Seconds()
+		localTarget := original.AsApproximateFloat64() - function.ExternalResponseTime/unit
+		published := resource.NewMilliQuantity(max(int64(math.Round(localTarget*1000)), 1), resource.DecimalSI)
+		if err := unstructured.SetNestedField(agreement.Object, published.String(), "spec", "metric", "responseTime"); err != nil {
+			return err
+		}
+
+		if annotations == nil {
+			annotations = make(map[string]string)
+		}
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		annotations[KosmosOriginalResponseTimeAnnotation] = original.String()
+		annotations[KosmosPublishedResponseTimeAnnotation] = published.String()
+		annotations[KosmosExternalResponseTimeAnnotation] = toDuration(function.ExternalResponseTime).Duration.Round(time.Millisecond).String()
+		annotations[KosmosEndToEndResponseTimeAnnotation] = toDuration(function.EndToEndResponseTime).Duration.Round(time.Millisecond).String()
+		if function.Budget != nil {
+			annotations[KosmosResponseTimeTargetAnnotation] = toDuration(function.Budget.ResponseTime).Duration.Round(time.Millisecond).String()
+		}
+		labels[KosmosGraphLabel] = graph.Name
+		labels[KosmosGraphNamespaceLabel] = graph.Namespace
+	}
+	agreement.SetAnnotations(annotations)
+	agreement.SetLabels(labels)
+	return nil
+}
+
+// responseTimeTarget reads spec.metric.responseTime of the agreement, a quantity written either as a number or as a string
+func responseTimeTarget(agreement *unstructured.Unstructured) (resource.Quantity, error) {
+	value, found, err := unstructured.NestedFieldNoCopy(agreement.Object, "spec", "metric", "responseTime")
+	if err != nil {
+		return resource.Quantity{}, err
+	}
+	if !found {
+		return resource.Quantity{}, fmt.Errorf("agreement %s has no spec.metric.responseTime", client.ObjectKeyFromObject(agreement))
+	}
+	switch value := value.(type) {
+	case string:
+		return resource.ParseQuantity(value)
+	case int64:
+		return *resource.NewQuantity(value, resource.DecimalSI), nil
+	case float64:
+		return resource.ParseQuantity(strconv.FormatFloat(value, 'f', -1, 64))
+	}
+	return resource.Quantity{}, fmt.Errorf("agreement %s has a spec.metric.responseTime of unexpected type %T", client.ObjectKeyFromObject(agreement), value)
+}
+
+func newServiceLevelAgreementList() *unstructured.UnstructuredList {
+	agreements := &unstructured.UnstructuredList{}
+	agreements.SetGroupVersionKind(ServiceLevelAgreementGVK.GroupVersion().WithKind(ServiceLevelAgreementGVK.Kind + "List"))
+	return agreements
+}
@@ -0,0 +1,185 @@
+package aggregator
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+var _ = Describe("Kosmos publisher", func() {
+	ctx := context.Background()
+	graph := types.NamespacedName{Namespace: "default", Name: "graph"}
+
+	agreement := func(namespace, name, service string, responseTime interface{}) *unstructured.Unstructured {
+		agreement := &unstructured.Unstructured{}
+		agreement.SetGroupVersionKind(ServiceLevelAgreementGVK)
+		agreement.SetNamespace(namespace)
+		agreement.SetName(name)
+		agreement.SetAnnotations(map[string]string{"owner": "kosmos"})
+		Expect(unstructured.SetNestedField(agreement.Object, service, "spec", "service", "name")).To(Succeed())
+		Expect(unstructured.SetNestedField(agreement.Object, responseTime, "spec", "metric", "responseTime")).To(Succeed())
+		return agreement
+	}
+	responseTime := func(agreement *unstructured.Unstructured) string {
+		target, err := responseTimeTarget(agreement)
+		Expect(err).NotTo(HaveOccurred())
+		return target.String()
+	}
+	get := func(c client.Client, namespace, name string) *unstructured.Unstructured {
+		agreement := &unstructured.Unstructured{}
+		agreement.SetGroupVersionKind(ServiceLevelAgreementGVK)
+		Expect(c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, agreement)).To(Succeed())
+		return agreement
+	}
+
+	var c client.Client
+	var publisher *KosmosPublisher
+	var patches int
+	result := &Result{
+		Graph:     graph,
+		Timestamp: time.Now(),
+		Functions: map[string]FunctionTimes{
+			"frontend": {Name: "frontend", Namespace: "fn", ResponseTime: 0.1, ExternalResponseTime: 0.25, EndToEndResponseTime: 0.35,
+				Budget: &Budget{EndToEnd: 0.3, ResponseTime: 0.08}},
+			"backend": {Name: "backend", Namespace: "fn", ResponseTime: 0.25, EndToEndResponseTime: 0.25},
+		},
+	}
+
+	BeforeEach(func() {
+		patches = 0
+		c = fake.NewClientBuilder().WithObjects(
+			// Targets in milliseconds, written as numbers or strings
+			agreement("fn", "frontend-sla", "frontend", int64(500)),
+			agreement("fn", "backend-sla", "backend", "300"),
+			agreement("fn", "other-sla", "other", int64(100)),
+		).WithInterceptorFuncs(interceptor.Funcs{
+			Patch: func(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+				patches++
+				return c.Patch(ctx, obj, patch, opts...)
+			},
+		}).Build()
+		publisher = NewKosmosPublisher(c, DefaultKosmosResponseTimeUnit)
+
+		Expect(publisher.Publish(ctx, result)).To(Succeed())
+	})
+
+	It("should subtract the external response time from the targets of the agreements of the functions of the graph", func() {
+		frontend := get(c, "fn", "frontend-sla")
+		Expect(responseTime(frontend)).To(Equal("250"))
+		Expect(frontend.GetAnnotations()).To(Equal(map[string]string{
+			"owner":                               "kosmos",
+			KosmosOriginalResponseTimeAnnotation:  "500",
+			KosmosPublishedResponseTimeAnnotation: "250",
+			KosmosExternalResponseTimeAnnotation:  "250ms",
+			KosmosEndToEndResponseTimeAnnotation:  "350ms",
+			KosmosResponseTimeTargetAnnotation:    "80ms",
+		}))
+		Expect(frontend.GetLabels()).To(Equal(map[string]string{KosmosGraphLabel: "graph", KosmosGraphNamespaceLabel: "default"}))
+
+		backend := get(c, "fn", "backend-sla")
+		Expect(responseTime(backend)).To(Equal("300"))
+		Expect(backend.GetAnnotations()).To(HaveKeyWithValue(KosmosExternalResponseTimeAnnotation, "0s"))
+		Expect(backend.GetAnnotations()).NotTo(HaveKey(KosmosResponseTimeTargetAnnotation))
+
+		other := get(c, "fn", "other-sla")
+		Expect(responseTime(other)).To(Equal("100"))
+		Expect(other.GetAnnotations()).To(Equal(map[string]string{"owner": "kosmos"}))
+	})
+
+	It("should use the target set while the publisher manages the agreement", func() {
+		frontend := get(c, "fn", "frontend-sla")
+		Expect(unstructured.SetNestedField(frontend.Object, "800", "spec", "metric", "responseTime")).To(Succeed())
+		Expect(c.Update(ctx, frontend)).To(Succeed())
+
+		Expect(publisher.Publish(ctx, result)).To(Succeed())
+		frontend = get(c, "fn", "frontend-sla")
+		Expect(responseTime(frontend)).To(Equal("550"))
+		Expect(frontend.GetAnnotations()).To(HaveKeyWithValue(KosmosOriginalResponseTimeAnnotation, "800"))
+	})
+
+	It("should not lower the targets below a thousandth of their unit", func() {
+		Expect(publisher.Publish(ctx, &Result{
+			Graph:     graph,
+			Timestamp: time.Now(),
+			Functions: map[string]FunctionTimes{
+				"frontend": {Name: "frontend", Namespace: "fn", ExternalResponseTime: 0.6},
+				"backend":  {Name: "backend", Namespace: "fn"},
+			},
+		})).To(Succeed())
+		Expect(responseTime(get(c, "fn", "frontend-sla"))).To(Equal("1m"))
+	})
+
+	It("should report the agreements without a target and publish on the others", func() {
+		missing := agreement("fn", "missing-sla", "missing", int64(1))
+		unstructured.RemoveNestedField(missing.Object, "spec", "metric")
+		Expect(c.Create(ctx, missing)).To(Succeed())
+
+		Expect(publisher.Publish(ctx, &Result{
+			Graph:     graph,
+			Timestamp: time.Now(),
+			Functions: map[string]FunctionTimes{
+				"frontend": {Name: "frontend", Namespace: "fn", ExternalResponseTime: 0.1},
+				"missing":  {Name: "missing", Namespace: "fn"},
+			},
+		})).To(MatchError(ContainSubstring("has no spec.metric.responseTime")))
+		Expect(responseTime(get(c, "fn", "frontend-sla"))).To(Equal("400"))
+	})
+
+	It("should only patch the agreements when a value changes", func() {
+		Expect(patches).To(Equal(2))
+		Expect(publisher.Publish(ctx, result)).To(Succeed())
+		Expect(patches).To(Equal(2))
+	})
+
+	It("should publish and retract nothing when Kosmos is not installed", func() {
+		noKosmos := fake.NewClientBuilder().WithInterceptorFuncs(interceptor.Funcs{
+			List: func(ctx context.Context, c client.WithWatch, list client.ObjectList, opts ...client.ListOption) error {
+				return &meta.NoKindMatchError{GroupKind: ServiceLevelAgreementGVK.GroupKind(), SearchedVersions: []string{"v1beta1"}}
+			},
+		}).Build()
+		Expect(NewKosmosPublisher(noKosmos, DefaultKosmosResponseTimeUnit).Publish(ctx, result)).To(Succeed())
+		Expect(NewKosmosPublisher(noKosmos, DefaultKosmosResponseTimeUnit).Retract(ctx, graph)).To(Succeed())
+	})
+
+	It("should keep the times of the last complete cycle when the aggregation times out", func() {
+		Expect(publisher.Publish(ctx, &Result{Graph: graph, TimedOut: true})).To(Succeed())
+		Expect(get(c, "fn", "frontend-sla").GetAnnotations()).To(HaveKeyWithValue(KosmosExternalResponseTimeAnnotation, "250ms"))
+	})
+
+	It("should clear the agreements of the functions that leave the graph", func() {
+		Expect(publisher.Publish(ctx, &Result{
+			Graph:     graph,
+			Timestamp: time.Now(),
+			Functions: map[string]FunctionTimes{
+				"frontend": {Name: "frontend", Namespace: "fn", ExternalResponseTime: 0.5},
+			},
+		})).To(Succeed())
+
+		frontend := get(c, "fn", "frontend-sla")
+		Expect(responseTime(frontend)).To(Equal("1m"))
+		Expect(frontend.GetAnnotations()).To(HaveKeyWithValue(KosmosExternalResponseTimeAnnotation, "500ms"))
+		Expect(frontend.GetAnnotations()).NotTo(HaveKey(KosmosResponseTimeTargetAnnotation))
+		backend := get(c, "fn", "backend-sla")
+		Expect(responseTime(backend)).To(Equal("300"))
+		Expect(backend.GetAnnotations()).To(Equal(map[string]string{"owner": "kosmos"}))
+		Expect(backend.GetLabels()).To(BeEmpty())
+	})
+
+	It("should restore every agreement of the graph when it is retracted", func() {
+		Expect(publisher.Retract(ctx, graph)).To(Succeed())
+		for _, name := range []string{"frontend-sla", "backend-sla"} {
+			Expect(get(c, "fn", name).GetAnnotations()).To(Equal(map[string]string{"owner": "kosmos"}))
+			Expect(get(c, "fn", name).GetLabels()).To(BeEmpty())
+		}
+		Expect(responseTime(get(c, "fn", "frontend-sla"))).To(Equal("500"))
+		Expect(responseTime(get(c, "fn", "backend-sla"))).To(Equal("300"))
+	})
+})
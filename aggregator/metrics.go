@@ -0,0 +1,86 @@
+package aggregator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/klog/v2"
+	custommetrics "k8s.io/metrics/pkg/client/custom_metrics"
+)
+
+// DefaultPodResponseTimeMetric is the custom metric that exposes the latest response time of a pod
+const DefaultPodResponseTimeMetric = "response_time"
+
+// ErrNoMetrics is returned by a MetricsSource when none of the pods of a function has a measurement yet
+var ErrNoMetrics = errors.New("no response time available")
+
+// Function describes a function of the graph along with the ready pods currently serving it
+type Function struct {
+	Name      string
+	Namespace string
+	Pods      []corev1.Pod
+}
+
+// MetricsSource provides the response time (in seconds) of the functions tracked by a graph.
+type MetricsSource interface {
+	ResponseTime(ctx context.Context, function Function) (float64, error)
+}
+
+// HistogramSource is implemented by the metrics sources that provide the distribution of the response time of the functions,
+// which the graphs that aggregate a percentile need.
+type HistogramSource interface {
+	ResponseTimeHistogram(ctx context.Context, function Function) (*Histogram, error)
+}
+
+// CallRatioSource is implemented by the metrics sources that can tell how many times a function invokes another one,
+// per call of the caller, for the edges that use the observed probability.
+type CallRatioSource interface {
+	CallRatio(ctx context.Context, caller Function, callee Function) (float64, error)
+}
+
+// RequestRateSource is implemented by the metrics sources that provide the requests per second a function receives,
+// which are measured on the entry functions of the graphs and propagated to the others.
+type RequestRateSource interface {
+	RequestRate(ctx context.Context, function Function) (float64, error)
+}
+
+// PodMetricsSource averages the latest response time reported by every pod of a function through the custom metrics API.
+type PodMetricsSource struct {
+	client     custommetrics.CustomMetricsClient
+	metricName string
+}
+
+func NewPodMetricsSource(client custommetrics.CustomMetricsClient, metricName string) *PodMetricsSource {
+	return &PodMetricsSource{
+		client:     client,
+		metricName: metricName,
+	}
+}
+
+func (s *PodMetricsSource) ResponseTime(ctx context.Context, function Function) (float64, error) {
+	sum := 0.0
+	count := 0
+	for _, pod := range function.Pods {
+		// The custom metrics client does not take a context, so check it between requests
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		value, err := s.client.NamespacedMetrics(function.Namespace).GetForObject(schema.GroupKind{Kind: "Pod"}, pod.Name, s.metricName, labels.Everything())
+		if err != nil {
+			// A pod that just started might not have reported anything yet, the others are still good enough
+			klog.V(2).InfoS("Could not get pod response time", "pod", pod.Name, "namespace", function.Namespace, "err", err)
+			continue
+		}
+		sum += value.Value.AsApproximateFloat64()
+		count++
+	}
+
+	if count == 0 {
+		return 0, fmt.Errorf("%w for function %s/%s", ErrNoMetrics, function.Namespace, function.Name)
+	}
+	return sum / float64(count), nil
+}
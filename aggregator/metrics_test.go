@@ -0,0 +1,72 @@
+package aggregator
+
+import (
+	"context"
+	"errors"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/metrics/pkg/apis/custom_metrics/v1beta2"
+	custommetricsfake "k8s.io/metrics/pkg/client/custom_metrics/fake"
+)
+
+var _ = Describe("Pod metrics source", func() {
+	ctx := context.Background()
+
+	// newSource serves the given response times, in seconds, for the pods that have one
+	newSource := func(responseTimes map[string]string) *PodMetricsSource {
+		client := &custommetricsfake.FakeCustomMetricsClient{}
+		client.AddReactor("get", "pods", func(action clienttesting.Action) (bool, runtime.Object, error) {
+			get := action.(custommetricsfake.GetForAction)
+			Expect(get.GetNamespace()).To(Equal("fn"))
+			Expect(get.GetMetricName()).To(Equal(DefaultPodResponseTimeMetric))
+			value, ok := responseTimes[get.GetName()]
+			if !ok {
+				return true, nil, errors.New("the server could not find the metric")
+			}
+			return true, &v1beta2.MetricValueList{Items: []v1beta2.MetricValue{{Value: resource.MustParse(value)}}}, nil
+		})
+		return NewPodMetricsSource(client, DefaultPodResponseTimeMetric)
+	}
+	function := func(pods ...string) Function {
+		function := Function{Name: "frontend", Namespace: "fn"}
+		for _, pod := range pods {
+			function.Pods = append(function.Pods, corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "fn", Name: pod}})
+		}
+		return function
+	}
+
+	It("should average the response times of the pods", func() {
+		responseTime, err := newSource(map[string]string{"frontend-1": "100m", "frontend-2": "300m"}).
+			ResponseTime(ctx, function("frontend-1", "frontend-2"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(responseTime).To(BeNumerically("~", 0.2, 1e-9))
+	})
+
+	It("should skip the pods that have not reported a response time", func() {
+		responseTime, err := newSource(map[string]string{"frontend-1": "100m"}).
+			ResponseTime(ctx, function("frontend-1", "frontend-2"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(responseTime).To(BeNumerically("~", 0.1, 1e-9))
+	})
+
+	It("should report no metrics when no pod has a response time", func() {
+		_, err := newSource(map[string]string{}).ResponseTime(ctx, function("frontend-1"))
+		Expect(err).To(MatchError(ErrNoMetrics))
+
+		_, err = newSource(map[string]string{}).ResponseTime(ctx, function())
+		Expect(err).To(MatchError(ErrNoMetrics))
+	})
+
+	It("should stop when the context is done", func() {
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err := newSource(map[string]string{"frontend-1": "100m"}).ResponseTime(canceled, function("frontend-1"))
+		Expect(err).To(MatchError(context.Canceled))
+	})
+})
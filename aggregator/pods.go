@@ -0,0 +1,48 @@
+package aggregator
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// listReadyPods returns the ready pods selected by the Service that exposes the function
+func listReadyPods(ctx context.Context, c client.Client, namespace string, functionName string) ([]corev1.Pod, error) {
+	service := &corev1.Service{}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: functionName}, service); err != nil {
+		return nil, err
+	}
+
+	// A service without selector would match every pod in the namespace
+	if len(service.Spec.Selector) == 0 {
+		return []corev1.Pod{}, nil
+	}
+
+	podList := &corev1.PodList{}
+	if err := c.List(ctx, podList, client.InNamespace(namespace), client.MatchingLabels(service.Spec.Selector)); err != nil {
+		return nil, err
+	}
+
+	readyPods := []corev1.Pod{}
+	for _, pod := range podList.Items {
+		if IsPodReady(&pod) {
+			readyPods = append(readyPods, pod)
+		}
+	}
+	return readyPods, nil
+}
+
+// IsPodReady reports whether the pod can serve requests
+func IsPodReady(pod *corev1.Pod) bool {
+	if pod.DeletionTimestamp != nil || pod.Status.Phase != corev1.PodRunning {
+		return false
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
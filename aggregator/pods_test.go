@@ -0,0 +1,84 @@
+package aggregator
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("Ready pods", func() {
+	ctx := context.Background()
+
+	pod := func(name string, labels map[string]string, ready bool) *corev1.Pod {
+		status := corev1.ConditionFalse
+		if ready {
+			status = corev1.ConditionTrue
+		}
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "fn", Name: name, Labels: labels},
+			Status: corev1.PodStatus{
+				Phase:      corev1.PodRunning,
+				Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: status}},
+			},
+		}
+	}
+	names := func(pods []corev1.Pod) []string {
+		result := []string{}
+		for _, pod := range pods {
+			result = append(result, pod.Name)
+		}
+		return result
+	}
+
+	It("should list the ready pods selected by the service of the function", func() {
+		c := fake.NewClientBuilder().WithObjects(
+			&corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "fn", Name: "frontend"},
+				Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "frontend"}},
+			},
+			pod("frontend-1", map[string]string{"app": "frontend"}, true),
+			pod("frontend-2", map[string]string{"app": "frontend"}, false),
+			pod("backend-1", map[string]string{"app": "backend"}, true),
+		).Build()
+
+		pods, err := listReadyPods(ctx, c, "fn", "frontend")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names(pods)).To(ConsistOf("frontend-1"))
+	})
+
+	It("should select no pod for a service without selector", func() {
+		c := fake.NewClientBuilder().WithObjects(
+			&corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "fn", Name: "external"}},
+			pod("frontend-1", map[string]string{"app": "frontend"}, true),
+		).Build()
+
+		pods, err := listReadyPods(ctx, c, "fn", "external")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pods).To(BeEmpty())
+	})
+
+	It("should fail when the function has no service", func() {
+		_, err := listReadyPods(ctx, fake.NewClientBuilder().Build(), "fn", "frontend")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should only consider running pods with the ready condition, that are not being deleted", func() {
+		Expect(IsPodReady(pod("ready", nil, true))).To(BeTrue())
+		Expect(IsPodReady(pod("not-ready", nil, false))).To(BeFalse())
+
+		pending := pod("pending", nil, true)
+		pending.Status.Phase = corev1.PodPending
+		Expect(IsPodReady(pending)).To(BeFalse())
+
+		terminating := pod("terminating", nil, true)
+		now := metav1.Now()
+		terminating.DeletionTimestamp = &now
+		Expect(IsPodReady(terminating)).To(BeFalse())
+
+		Expect(IsPodReady(&corev1.Pod{Status: corev1.PodStatus{Phase: corev1.PodRunning}})).To(BeFalse())
+	})
+})
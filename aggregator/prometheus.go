@@ -0,0 +1,238 @@
+package aggregator
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"text/template"
+	"time"
+
+	promapi "github.com/prometheus/client_golang/api"
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"k8s.io/klog/v2"
+)
+
+// Default queries target the request duration histogram exported by the OpenFaaS gateway.
+// Queries are Go templates: {{.Function}} and {{.Namespace}} identify the function and {{.Quantile}} is the requested percentile in [0, 1].
+// The histogram query must return one series per bucket, with the upper bound of the bucket in the le label.
+const (
+	DefaultPrometheusMeanQuery = `sum(rate(gateway_functions_seconds_sum{function_name="{{.Function}}.{{.Namespace}}"}[1m])) / ` +
+		`sum(rate(gateway_functions_seconds_count{function_name="{{.Function}}.{{.Namespace}}"}[1m]))`
+	DefaultPrometheusPercentileQuery = `histogram_quantile({{.Quantile}}, ` +
+		`sum by (le) (rate(gateway_functions_seconds_bucket{function_name="{{.Function}}.{{.Namespace}}"}[1m])))`
+	DefaultPrometheusHistogramQuery   = `sum by (le) (rate(gateway_functions_seconds_bucket{function_name="{{.Function}}.{{.Namespace}}"}[1m]))`
+	DefaultPrometheusRequestRateQuery = `sum(rate(gateway_function_invocation_total{function_name="{{.Function}}.{{.Namespace}}"}[1m]))`
+)
+
+const prometheusQueryTimeout = 10 * time.Second
+
+type PrometheusQueries struct {
+	// Mean returns the average response time of a function, in seconds
+	Mean string
+	// Percentile returns the {{.Quantile}} percentile of the response time of a function, in seconds
+	Percentile string
+	// Histogram returns the cumulative buckets of the response time of a function, by upper bound in seconds (le)
+	Histogram string
+	// RequestRate returns the requests per second a function receives
+	RequestRate string
+	// CallRatio returns how many times the function invokes {{.Callee}} in {{.CalleeNamespace}}, per call of the function.
+	// There is no default, as the gateway metrics do not record the caller of a request.
+	CallRatio string
+}
+
+// PrometheusMetricsSource gets function response times from the request duration metrics stored in Prometheus.
+type PrometheusMetricsSource struct {
+	api         promv1.API
+	mean        *template.Template
+	percentile  *template.Template
+	histogram   *template.Template
+	requestRate *template.Template
+	// callRatio is nil when no query is configured
+	callRatio *template.Template
+	// Quantile, if set, makes ResponseTime report this percentile instead of the mean
+	quantile float64
+}
+
+// queryParams are the values available to the query templates
+type queryParams struct {
+	Function  string
+	Namespace string
+	Quantile  string
+	// Callee and CalleeNamespace identify the invoked function in the call ratio query
+	Callee          string
+	CalleeNamespace string
+}
+
+func NewPrometheusMetricsSource(address string, queries PrometheusQueries, quantile float64) (*PrometheusMetricsSource, error) {
+	if quantile < 0 || quantile > 1 {
+		return nil, fmt.Errorf("quantile must be in [0, 1], got %v", quantile)
+	}
+
+	client, err := promapi.NewClient(promapi.Config{Address: address})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create prometheus client: %w", err)
+	}
+
+	if queries.Mean == "" {
+		queries.Mean = DefaultPrometheusMeanQuery
+	}
+	if queries.Percentile == "" {
+		queries.Percentile = DefaultPrometheusPercentileQuery
+	}
+	if queries.Histogram == "" {
+		queries.Histogram = DefaultPrometheusHistogramQuery
+	}
+	if queries.RequestRate == "" {
+		queries.RequestRate = DefaultPrometheusRequestRateQuery
+	}
+	mean, err := template.New("mean").Option("missingkey=error").Parse(queries.Mean)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mean query: %w", err)
+	}
+	percentile, err := template.New("percentile").Option("missingkey=error").Parse(queries.Percentile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid percentile query: %w", err)
+	}
+	histogram, err := template.New("histogram").Option("missingkey=error").Parse(queries.Histogram)
+	if err != nil {
+		return nil, fmt.Errorf("invalid histogram query: %w", err)
+	}
+	requestRate, err := template.New("request rate").Option("missingkey=error").Parse(queries.RequestRate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request rate query: %w", err)
+	}
+	var callRatio *template.Template
+	if queries.CallRatio != "" {
+		if callRatio, err = template.New("call ratio").Option("missingkey=error").Parse(queries.CallRatio); err != nil {
+			return nil, fmt.Errorf("invalid call ratio query: %w", err)
+		}
+	}
+
+	return &PrometheusMetricsSource{
+		api:         promv1.NewAPI(client),
+		mean:        mean,
+		percentile:  percentile,
+		histogram:   histogram,
+		requestRate: requestRate,
+		callRatio:   callRatio,
+		quantile:    quantile,
+	}, nil
+}
+
+func (s *PrometheusMetricsSource) ResponseTime(ctx context.Context, function Function) (float64, error) {
+	if s.quantile > 0 {
+		return s.PercentileResponseTime(ctx, function, s.quantile)
+	}
+	return s.MeanResponseTime(ctx, function)
+}
+
+// MeanResponseTime returns the average response time of the function over the window of the mean query.
+func (s *PrometheusMetricsSource) MeanResponseTime(ctx context.Context, function Function) (float64, error) {
+	return s.query(ctx, s.mean, function, queryParams{Function: function.Name, Namespace: function.Namespace})
+}
+
+// PercentileResponseTime returns the given quantile (e.g. 0.95) of the response time of the function.
+func (s *PrometheusMetricsSource) PercentileResponseTime(ctx context.Context, function Function, quantile float64) (float64, error) {
+	return s.query(ctx, s.percentile, function, queryParams{
+		Function:  function.Name,
+		Namespace: function.Namespace,
+		Quantile:  strconv.FormatFloat(quantile, 'f', -1, 64),
+	})
+}
+
+// ResponseTimeHistogram returns the distribution of the response time of the function over the window of the histogram query.
+func (s *PrometheusMetricsSource) ResponseTimeHistogram(ctx context.Context, function Function) (*Histogram, error) {
+	result, _, err := s.run(ctx, s.histogram, function, queryParams{Function: function.Name, Namespace: function.Namespace})
+	if err != nil {
+		return nil, err
+	}
+	vector, ok := result.(model.Vector)
+	if !ok {
+		return nil, fmt.Errorf("unexpected prometheus result type %s for function %s/%s", result.Type(), function.Namespace, function.Name)
+	}
+
+	buckets := make([]HistogramBucket, 0, len(vector))
+	for _, sample := range vector {
+		upperBound, err := strconv.ParseFloat(string(sample.Metric[model.BucketLabel]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket %q for function %s/%s: %w", sample.Metric[model.BucketLabel], function.Namespace, function.Name, err)
+		}
+		buckets = append(buckets, HistogramBucket{UpperBound: upperBound, Count: float64(sample.Value)})
+	}
+	histogram, err := NewHistogram(buckets)
+	if err != nil {
+		return nil, fmt.Errorf("%w for function %s/%s", err, function.Namespace, function.Name)
+	}
+	return histogram, nil
+}
+
+// RequestRate returns the requests per second the function receives, over the window of the request rate query.
+func (s *PrometheusMetricsSource) RequestRate(ctx context.Context, function Function) (float64, error) {
+	return s.query(ctx, s.requestRate, function, queryParams{Function: function.Name, Namespace: function.Namespace})
+}
+
+// CallRatio returns how many times the caller invokes the callee per call, over the window of the call ratio query.
+func (s *PrometheusMetricsSource) CallRatio(ctx context.Context, caller Function, callee Function) (float64, error) {
+	if s.callRatio == nil {
+		return 0, fmt.Errorf("%w: no call ratio query configured", ErrNoMetrics)
+	}
+	return s.query(ctx, s.callRatio, caller, queryParams{
+		Function:        caller.Name,
+		Namespace:       caller.Namespace,
+		Callee:          callee.Name,
+		CalleeNamespace: callee.Namespace,
+	})
+}
+
+func (s *PrometheusMetricsSource) query(ctx context.Context, tmpl *template.Template, function Function, params queryParams) (float64, error) {
+	result, query, err := s.run(ctx, tmpl, function, params)
+	if err != nil {
+		return 0, err
+	}
+
+	var value model.SampleValue
+	switch v := result.(type) {
+	case model.Vector:
+		if len(v) == 0 {
+			return 0, fmt.Errorf("%w for function %s/%s", ErrNoMetrics, function.Namespace, function.Name)
+		}
+		if len(v) > 1 {
+			klog.V(2).InfoS("Prometheus query returned more than one series, using the first one", "query", query, "series", len(v))
+		}
+		value = v[0].Value
+	case *model.Scalar:
+		value = v.Value
+	default:
+		return 0, fmt.Errorf("unexpected prometheus result type %s for function %s/%s", result.Type(), function.Namespace, function.Name)
+	}
+
+	// No requests in the query window: 0/0 in the mean and NaN in histogram_quantile
+	if math.IsNaN(float64(value)) || math.IsInf(float64(value), 0) {
+		return 0, fmt.Errorf("%w for function %s/%s", ErrNoMetrics, function.Namespace, function.Name)
+	}
+
+	return float64(value), nil
+}
+
+// run renders the query for the function and runs it, returning the result along with the rendered query
+func (s *PrometheusMetricsSource) run(ctx context.Context, tmpl *template.Template, function Function, params queryParams) (model.Value, string, error) {
+	var query bytes.Buffer
+	if err := tmpl.Execute(&query, params); err != nil {
+		return nil, "", fmt.Errorf("failed to render %s query: %w", tmpl.Name(), err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, prometheusQueryTimeout)
+	defer cancel()
+
+	result, warnings, err := s.api.Query(ctx, query.String(), time.Now())
+	if err != nil {
+		return nil, query.String(), fmt.Errorf("prometheus query failed for function %s/%s: %w", function.Namespace, function.Name, err)
+	}
+	if len(warnings) > 0 {
+		klog.V(2).InfoS("Prometheus query returned warnings", "query", query.String(), "warnings", warnings)
+	}
+	return result, query.String(), nil
+}
@@ -0,0 +1,169 @@
+package aggregator
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// fakePrometheus serves the instant query endpoint of the Prometheus HTTP API with a fixed result per query
+type fakePrometheus struct {
+	server  *httptest.Server
+	results map[string]string            // query -> value ("" means empty vector)
+	buckets map[string]map[string]string // query -> le -> value, for histogram queries
+	queries []string
+}
+
+func newFakePrometheus() *fakePrometheus {
+	p := &fakePrometheus{results: map[string]string{}, buckets: map[string]map[string]string{}}
+	p.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer GinkgoRecover()
+		Expect(r.URL.Path).To(Equal("/api/v1/query"))
+		Expect(r.ParseForm()).To(Succeed())
+
+		query := r.Form.Get("query")
+		p.queries = append(p.queries, query)
+
+		vector := []any{}
+		value, ok := p.results[query]
+		if buckets, isHistogram := p.buckets[query]; isHistogram {
+			for le, count := range buckets {
+				vector = append(vector, map[string]any{"metric": map[string]string{"le": le}, "value": []any{1700000000, count}})
+			}
+			ok = true
+		}
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"status": "error", "errorType": "bad_data", "error": "unexpected query",
+			})
+			return
+		}
+
+		if value != "" {
+			vector = append(vector, map[string]any{"metric": map[string]string{}, "value": []any{1700000000, value}})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"status": "success",
+			"data":   map[string]any{"resultType": "vector", "result": vector},
+		})
+	}))
+	return p
+}
+
+var _ = Describe("PrometheusMetricsSource", func() {
+	ctx := context.Background()
+	var prometheus *fakePrometheus
+	function := Function{Name: "frontend", Namespace: "openfaas-fn"}
+	queries := PrometheusQueries{
+		Mean:       `mean{fn="{{.Function}}",ns="{{.Namespace}}"}`,
+		Percentile: `pct{fn="{{.Function}}",ns="{{.Namespace}}",q="{{.Quantile}}"}`,
+		Histogram:  `buckets{fn="{{.Function}}",ns="{{.Namespace}}"}`,
+		CallRatio:  `calls{from="{{.Function}}.{{.Namespace}}",to="{{.Callee}}.{{.CalleeNamespace}}"}`,
+	}
+
+	BeforeEach(func() {
+		prometheus = newFakePrometheus()
+		DeferCleanup(prometheus.server.Close)
+	})
+
+	It("should render the mean query for the function and return its value", func() {
+		prometheus.results[`mean{fn="frontend",ns="openfaas-fn"}`] = "0.25"
+
+		source, err := NewPrometheusMetricsSource(prometheus.server.URL, queries, 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(source.ResponseTime(ctx, function)).To(BeNumerically("~", 0.25, 1e-9))
+		Expect(prometheus.queries).To(ConsistOf(`mean{fn="frontend",ns="openfaas-fn"}`))
+	})
+
+	It("should use the percentile query when a quantile is configured", func() {
+		prometheus.results[`pct{fn="frontend",ns="openfaas-fn",q="0.95"}`] = "0.8"
+		prometheus.results[`pct{fn="frontend",ns="openfaas-fn",q="0.5"}`] = "0.3"
+
+		source, err := NewPrometheusMetricsSource(prometheus.server.URL, queries, 0.95)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(source.ResponseTime(ctx, function)).To(BeNumerically("~", 0.8, 1e-9))
+		Expect(source.PercentileResponseTime(ctx, function, 0.5)).To(BeNumerically("~", 0.3, 1e-9))
+	})
+
+	It("should report missing metrics for empty results and NaN values", func() {
+		prometheus.results[`mean{fn="frontend",ns="openfaas-fn"}`] = ""
+		prometheus.results[`pct{fn="frontend",ns="openfaas-fn",q="0.99"}`] = "NaN"
+
+		source, err := NewPrometheusMetricsSource(prometheus.server.URL, queries, 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = source.MeanResponseTime(ctx, function)
+		Expect(err).To(MatchError(ErrNoMetrics))
+		_, err = source.PercentileResponseTime(ctx, function, 0.99)
+		Expect(err).To(MatchError(ErrNoMetrics))
+	})
+
+	It("should build the histogram of the function from its buckets", func() {
+		prometheus.buckets[`buckets{fn="frontend",ns="openfaas-fn"}`] = map[string]string{"0.1": "5", "0.2": "10", "+Inf": "10"}
+
+		source, err := NewPrometheusMetricsSource(prometheus.server.URL, queries, 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		histogram, err := source.ResponseTimeHistogram(ctx, function)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(histogram.Quantile(0.75)).To(BeNumerically("~", 0.15, 0.02))
+
+		prometheus.buckets[`buckets{fn="frontend",ns="openfaas-fn"}`] = map[string]string{"0.1": "0", "+Inf": "0"}
+		_, err = source.ResponseTimeHistogram(ctx, function)
+		Expect(err).To(MatchError(ErrNoMetrics))
+	})
+
+	It("should render the request rate query", func() {
+		prometheus.results[`sum(rate(gateway_function_invocation_total{function_name="frontend.openfaas-fn"}[1m]))`] = "12.5"
+
+		source, err := NewPrometheusMetricsSource(prometheus.server.URL, PrometheusQueries{}, 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(source.RequestRate(ctx, function)).To(BeNumerically("~", 12.5, 1e-9))
+	})
+
+	It("should render the call ratio query for both functions", func() {
+		prometheus.results[`calls{from="frontend.openfaas-fn",to="cache.other"}`] = "0.3"
+
+		source, err := NewPrometheusMetricsSource(prometheus.server.URL, queries, 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(source.CallRatio(ctx, function, Function{Name: "cache", Namespace: "other"})).To(BeNumerically("~", 0.3, 1e-9))
+
+		source, err = NewPrometheusMetricsSource(prometheus.server.URL, PrometheusQueries{}, 0)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = source.CallRatio(ctx, function, Function{Name: "cache", Namespace: "other"})
+		Expect(err).To(MatchError(ErrNoMetrics))
+	})
+
+	It("should return query errors", func() {
+		source, err := NewPrometheusMetricsSource(prometheus.server.URL, queries, 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = source.ResponseTime(ctx, function)
+		Expect(err).To(HaveOccurred())
+		Expect(err).NotTo(MatchError(ErrNoMetrics))
+	})
+
+	It("should reject invalid configurations", func() {
+		_, err := NewPrometheusMetricsSource(prometheus.server.URL, queries, 1.5)
+		Expect(err).To(HaveOccurred())
+
+		_, err = NewPrometheusMetricsSource(prometheus.server.URL, PrometheusQueries{Mean: "{{.Function"}, 0)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should default to the OpenFaaS gateway queries", func() {
+		source, err := NewPrometheusMetricsSource(prometheus.server.URL, PrometheusQueries{}, 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, _ = source.ResponseTime(ctx, function)
+		Expect(prometheus.queries).To(HaveLen(1))
+		Expect(prometheus.queries[0]).To(ContainSubstring(`gateway_functions_seconds_sum{function_name="frontend.openfaas-fn"}`))
+	})
+})
@@ -0,0 +1,68 @@
+package aggregator
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// RawTimes are the times of a function computed from the measurements of the cycle, before smoothing
+type RawTimes struct {
+	ResponseTime         float64
+	ExternalResponseTime float64
+	EndToEndResponseTime float64
+}
+
+// FunctionTimes holds the times computed for a function of the graph during an aggregation cycle.
+// The times are computed from the smoothed response times, if the graph asks for smoothing, and Raw from the measured ones.
+// When the graph selects a percentile, every time is that percentile of the distribution of the time instead of its average.
+type FunctionTimes struct {
+	Name      string
+	Namespace string
+	// Pods are the names of the ready pods serving the function
+	Pods []string
+	// Measured is false when no response time could be collected for the function in this cycle
+	Measured bool
+	// ResponseTime is the (smoothed) response time of the function, in seconds
+	ResponseTime float64
+	// ExternalResponseTime is the time the function spends waiting on the functions it invokes, in seconds
+	ExternalResponseTime float64
+	// EndToEndResponseTime is the response time of the function including the end-to-end time of the functions it invokes, in seconds
+	EndToEndResponseTime float64
+	// EdgeGroups are the aggregated times of the groups of invocations performed by the function, indexed by edge id
+	EdgeGroups map[int32]float64
+	// Budget is the share of the response time SLOs of the graph assigned to the function, nil if no SLO depends on it
+	Budget *Budget
+	// ExpectedRequestRate is the requests per second the function should receive, given the ones received by the entry
+	// functions of the graph. It is only meaningful if RequestRateKnown.
+	ExpectedRequestRate float64
+	// RequestRateKnown is false when the metrics source does not provide the request rate of an entry function the
+	// function is reached from
+	RequestRateKnown bool
+	// Raw are the times computed from the measurements of the cycle only
+	Raw RawTimes
+}
+
+// Result is the outcome of an aggregation cycle of a graph
+type Result struct {
+	Graph     types.NamespacedName
+	Timestamp time.Time
+	// TimedOut is true when the cycle ran out of time before every function was measured.
+	// The times of the functions are then incomplete and should not be used.
+	TimedOut bool
+	// PercentileUnsupported is true when the graph selects a percentile but the metrics source does not provide histograms.
+	// Nothing is computed: Functions is empty, so that the publishers withdraw the times they published for the graph.
+	PercentileUnsupported bool
+	// Functions are indexed by function name
+	Functions map[string]FunctionTimes
+	// CriticalPaths are the critical paths of the entry functions of the graph, computed from the same times as Functions
+	CriticalPaths []CriticalPath
+}
+
+// Publisher makes the times computed by the aggregator available outside of the controller.
+type Publisher interface {
+	Publish(ctx context.Context, result *Result) error
+	// Retract removes everything published for the graph, once it is deleted
+	Retract(ctx context.Context, graph types.NamespacedName) error
+}
@@ -0,0 +1,60 @@
+package aggregator
+
+// propagateRequestRates pushes the request rate observed on the entry functions down the graph, returning the requests
+// per second every function is expected to receive. Every kind of edge counts, weighed by how many times it is invoked
+// (see edgeCalls) and by the attempts of its retries, which depend on the end-to-end times of the callees.
+// The rate of a function is only known, and so returned, when the rates of all the entry functions it is reached from are.
+// Nodes must be sorted leaf first, so that a function has received the requests of all its callers before passing them on.
+func propagateRequestRates(nodes []FunctionNode, entryRates map[string]float64, callRatios map[invocationKey]float64, endToEnd map[string]float64) map[string]float64 {
+	rates := make(map[string]float64, len(nodes))
+	for function, rate := range entryRates {
+		rates[function] = rate
+	}
+	// Functions invoked by at least one function, and the ones invoked by a function whose rate is unknown
+	invoked := make(map[string]bool, len(nodes))
+	unknown := make(map[string]bool, len(nodes))
+
+	observed := observedCalls(nodes, callRatios)
+	for i := len(nodes) - 1; i >= 0; i-- {
+		caller := nodes[i]
+		if _, isEntry := entryRates[caller.FunctionName]; unknown[caller.FunctionName] || (!invoked[caller.FunctionName] && !isEntry) {
+			unknown[caller.FunctionName] = true
+			delete(rates, caller.FunctionName)
+		}
+		for _, edge := range caller.Invocations {
+			invoked[edge.FunctionName] = true
+			if unknown[caller.FunctionName] {
+				unknown[edge.FunctionName] = true
+				continue
+			}
+			ratio, hasObserved := observed[invocationKey{caller: caller.FunctionName, callee: edge.FunctionName}]
+			invocations := 0.0
+			for _, call := range edgeCalls(edge, ratio, hasObserved) {
+				invocations += float64(call.count) * call.probability
+			}
+			if model, ok := edgeRetryModel(edge); ok {
+				attempts, _ := expectedAttempts(endToEnd[edge.FunctionName], model)
+				invocations *= attempts
+			}
+			rates[edge.FunctionName] += rates[caller.FunctionName] * invocations
+		}
+	}
+	return rates
+}
+
+// entryFunctions returns the functions of the graph that no other function invokes, in any way
+func entryFunctions(nodes []FunctionNode) []FunctionNode {
+	invoked := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		for _, edge := range node.Invocations {
+			invoked[edge.FunctionName] = true
+		}
+	}
+	entries := []FunctionNode{}
+	for _, node := range nodes {
+		if !invoked[node.FunctionName] {
+			entries = append(entries, node)
+		}
+	}
+	return entries
+}
@@ -0,0 +1,72 @@
+package aggregator
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	provisioningv1alpha1 "github.com/itspeetah/neptune-depdag-controller/api/v1alpha1"
+)
+
+var _ = Describe("Request rates", func() {
+	half := resource.MustParse("0.5")
+	errorRate := resource.MustParse("0.5")
+	nodes := sortNodesByDependencies([]FunctionNode{
+		{FunctionName: "A", Invocations: []provisioningv1alpha1.InvocationEdge{
+			{FunctionName: "B", EdgeId: 1, EdgeMultiplier: 2},
+			{FunctionName: "C", EdgeId: 2, EdgeMultiplier: 1, Probability: &half},
+			{FunctionName: "D", EdgeId: 3, EdgeMultiplier: 1, Kind: provisioningv1alpha1.EdgeKindAsync},
+		}},
+		{FunctionName: "B", Invocations: []provisioningv1alpha1.InvocationEdge{
+			{FunctionName: "C", EdgeId: 1, EdgeMultiplier: 1, Retries: 1, ErrorRate: &errorRate},
+		}},
+		{FunctionName: "C"},
+		{FunctionName: "D"},
+		{FunctionName: "E", Invocations: []provisioningv1alpha1.InvocationEdge{
+			{FunctionName: "C", EdgeId: 1, EdgeMultiplier: 1, Timeout: &metav1.Duration{Duration: time.Second}},
+		}},
+	})
+
+	It("should find the functions that nobody invokes", func() {
+		entries := []string{}
+		for _, node := range entryFunctions(nodes) {
+			entries = append(entries, node.FunctionName)
+		}
+		Expect(entries).To(ConsistOf("A", "E"))
+	})
+
+	It("should push the rate of the entry functions down every kind of edge", func() {
+		rates := propagateRequestRates(nodes, map[string]float64{"A": 10, "E": 1}, nil, map[string]float64{"C": 2})
+		Expect(rates["A"]).To(BeNumerically("~", 10, 1e-9))
+		Expect(rates["B"]).To(BeNumerically("~", 20, 1e-9))
+		Expect(rates["D"]).To(BeNumerically("~", 10, 1e-9))
+		// Half of the calls of A, 1.5 attempts per call of B and one attempt per call of E, which times out without retrying
+		Expect(rates["C"]).To(BeNumerically("~", 5+30+1, 1e-9))
+	})
+
+	It("should not know the rate of the functions reached from an entry function without a rate", func() {
+		rates := propagateRequestRates(nodes, map[string]float64{"A": 10}, nil, nil)
+		Expect(rates).To(HaveKeyWithValue("A", BeNumerically("~", 10, 1e-9)))
+		Expect(rates).To(HaveKeyWithValue("B", BeNumerically("~", 20, 1e-9)))
+		Expect(rates).To(HaveKey("D"))
+		// C is also invoked by E
+		Expect(rates).NotTo(HaveKey("C"))
+		Expect(rates).NotTo(HaveKey("E"))
+
+		Expect(propagateRequestRates(nodes, map[string]float64{}, nil, nil)).To(BeEmpty())
+	})
+
+	It("should use the observed call ratios", func() {
+		nodes := sortNodesByDependencies([]FunctionNode{
+			{FunctionName: "A", Invocations: []provisioningv1alpha1.InvocationEdge{
+				{FunctionName: "B", EdgeId: 1, EdgeMultiplier: 1, ObservedProbability: true},
+			}},
+			{FunctionName: "B"},
+		})
+		rates := propagateRequestRates(nodes, map[string]float64{"A": 10}, map[invocationKey]float64{{caller: "A", callee: "B"}: 0.2}, nil)
+		Expect(rates["B"]).To(BeNumerically("~", 2, 1e-9))
+	})
+})
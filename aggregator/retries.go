@@ -0,0 +1,93 @@
+package aggregator
+
+import provisioningv1alpha1 "github.com/itspeetah/neptune-depdag-controller/api/v1alpha1"
+
+// retryModel is how a caller handles the failures of the invocations along an edge, with times in seconds.
+// Attempts fail independently of each other, either with the error rate or by running past the timeout.
+type retryModel struct {
+	retries int32
+	backoff float64
+	// timeout is 0 when the caller waits as long as it takes
+	timeout   float64
+	errorRate float64
+}
+
+// edgeRetryModel returns the retry model of the edge, or false if the edge has none and its time is the one of the callee
+func edgeRetryModel(edge provisioningv1alpha1.InvocationEdge) (retryModel, bool) {
+	model := retryModel{retries: max(edge.Retries, 0)}
+	if edge.RetryBackoff != nil {
+		model.backoff = max(edge.RetryBackoff.Seconds(), 0)
+	}
+	if edge.Timeout != nil {
+		model.timeout = max(edge.Timeout.Seconds(), 0)
+	}
+	if edge.ErrorRate != nil {
+		model.errorRate = min(max(edge.ErrorRate.AsApproximateFloat64(), 0), 1)
+	}
+	return model, model.timeout > 0 || (model.retries > 0 && model.errorRate > 0)
+}
+
+// expectedAttempts returns the average number of attempts of an invocation that takes t seconds, and the time of each attempt
+func expectedAttempts(t float64, model retryModel) (float64, float64) {
+	attempt, timedOut := t, 0.0
+	if model.timeout > 0 && t > model.timeout {
+		attempt, timedOut = model.timeout, 1
+	}
+	failure := model.errorRate + (1-model.errorRate)*timedOut
+
+	// An attempt happens only if all of the previous ones failed
+	attempts, probability := 0.0, 1.0
+	for range model.retries + 1 {
+		attempts += probability
+		probability *= failure
+	}
+	return attempts, attempt
+}
+
+// expectedRetriedTime is the average time of an invocation that takes t seconds, including its retries.
+// Every attempt takes t, capped by the timeout, and is followed by a backoff if it is retried.
+func expectedRetriedTime(t float64, model retryModel) float64 {
+	attempts, attempt := expectedAttempts(t, model)
+	return attempts*attempt + (attempts-1)*model.backoff
+}
+
+// retriedHistogram is the distribution of the time of an invocation that follows t, including its retries
+func retriedHistogram(t *Histogram, model retryModel) *Histogram {
+	succeeded, timedOut := t, 0.0
+	capped := t
+	if model.timeout > 0 {
+		succeeded, timedOut = t.below(model.timeout)
+		capped = t.capped(model.timeout)
+	}
+	failure := model.errorRate + (1-model.errorRate)*timedOut
+	if failure == 0 {
+		return t
+	}
+
+	// A failed attempt either returned an error, taking as long as usual, or ran until the timeout
+	failed := capped
+	if timedOut > 0 {
+		failed = mixHistograms(
+			[]*Histogram{capped, pointHistogram(model.timeout)},
+			[]float64{model.errorRate / failure, (1 - model.errorRate) * timedOut / failure},
+		)
+	}
+
+	// The invocation ends with the first successful attempt, or with the last one
+	histograms, weights := []*Histogram{}, []float64{}
+	failures, probability := pointHistogram(0), 1.0
+	for attempt := range model.retries + 1 {
+		if succeeded != nil && failure < 1 {
+			histograms = append(histograms, failures.Add(succeeded))
+			weights = append(weights, probability*(1-failure))
+		}
+		if attempt == model.retries {
+			histograms = append(histograms, failures.Add(failed))
+			weights = append(weights, probability*failure)
+			break
+		}
+		failures = failures.Add(failed).Add(pointHistogram(model.backoff))
+		probability *= failure
+	}
+	return mixHistograms(histograms, weights)
+}
@@ -0,0 +1,64 @@
+package aggregator
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	provisioningv1alpha1 "github.com/itspeetah/neptune-depdag-controller/api/v1alpha1"
+)
+
+var _ = Describe("Retries", func() {
+	It("should only model the edges that can time out or retry errors", func() {
+		_, ok := edgeRetryModel(provisioningv1alpha1.InvocationEdge{Retries: 3})
+		Expect(ok).To(BeFalse())
+
+		errorRate := resource.MustParse("0.1")
+		model, ok := edgeRetryModel(provisioningv1alpha1.InvocationEdge{
+			Retries: 3, ErrorRate: &errorRate, RetryBackoff: &metav1.Duration{Duration: 100 * time.Millisecond},
+		})
+		Expect(ok).To(BeTrue())
+		Expect(model).To(Equal(retryModel{retries: 3, backoff: 0.1, errorRate: 0.1}))
+
+		_, ok = edgeRetryModel(provisioningv1alpha1.InvocationEdge{Timeout: &metav1.Duration{Duration: time.Second}})
+		Expect(ok).To(BeTrue())
+	})
+
+	It("should inflate the average time with the expected retries", func() {
+		// 1 + 0.5 + 0.25 attempts on average, with a backoff before the retries
+		Expect(expectedRetriedTime(0.2, retryModel{retries: 2, backoff: 0.1, errorRate: 0.5})).To(BeNumerically("~", 0.425, 1e-9))
+		// Every attempt times out
+		Expect(expectedRetriedTime(1, retryModel{retries: 1, backoff: 0.1, timeout: 0.3})).To(BeNumerically("~", 0.7, 1e-9))
+		Expect(expectedRetriedTime(0.2, retryModel{timeout: 0.3})).To(BeNumerically("~", 0.2, 1e-9))
+	})
+
+	It("should mix the distributions of the attempts", func() {
+		retried := retriedHistogram(pointHistogram(0.2), retryModel{retries: 1, backoff: 0.1, errorRate: 0.5})
+		Expect(retried.points).To(HaveLen(2))
+		Expect(retried.points[0].value).To(BeNumerically("~", 0.2, 1e-9))
+		Expect(retried.points[0].probability).To(BeNumerically("~", 0.5, 1e-9))
+		Expect(retried.points[1].value).To(BeNumerically("~", 0.5, 1e-9))
+		Expect(retried.points[1].probability).To(BeNumerically("~", 0.5, 1e-9))
+	})
+
+	It("should retry the attempts that time out", func() {
+		twoValues := &Histogram{points: []histogramPoint{{value: 1, probability: 0.5}, {value: 2, probability: 0.5}}}
+		retried := retriedHistogram(twoValues, retryModel{retries: 1, timeout: 1.5})
+		Expect(retried.points).To(Equal([]histogramPoint{{value: 1, probability: 0.5}, {value: 2.5, probability: 0.25}, {value: 3, probability: 0.25}}))
+	})
+
+	It("should cap the time of the edges at their timeout", func() {
+		nodes := sortNodesByDependencies([]FunctionNode{
+			{FunctionName: "A", Invocations: []provisioningv1alpha1.InvocationEdge{
+				{FunctionName: "B", EdgeId: 1, EdgeMultiplier: 2, Timeout: &metav1.Duration{Duration: 300 * time.Millisecond}},
+			}},
+			{FunctionName: "B"},
+		})
+		times := aggregateEdgeGroups(nodes, map[string]float64{"A": 0.1, "B": 0.5}, nil, false)
+		Expect(times.edgeGroups["A"][1]).To(BeNumerically("~", 0.6, 1e-9))
+		Expect(times.endToEnd["A"]).To(BeNumerically("~", 0.7, 1e-9))
+	})
+})
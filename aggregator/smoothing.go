@@ -0,0 +1,108 @@
+package aggregator
+
+import (
+	"sort"
+
+	provisioningv1alpha1 "github.com/itspeetah/neptune-depdag-controller/api/v1alpha1"
+)
+
+// smoother keeps the measurements of a function across cycles
+type smoother interface {
+	// Add records a measurement and returns the smoothed value
+	Add(value float64) float64
+	// Value returns the smoothed value, if anything was recorded
+	Value() (float64, bool)
+}
+
+// normalizeSmoothing fills in the defaults of the smoothing of a graph
+func normalizeSmoothing(smoothing *provisioningv1alpha1.Smoothing) provisioningv1alpha1.Smoothing {
+	normalized := provisioningv1alpha1.Smoothing{Method: provisioningv1alpha1.SmoothingNone}
+	if smoothing == nil {
+		return normalized
+	}
+	normalized = *smoothing
+	if normalized.Method == "" {
+		normalized.Method = provisioningv1alpha1.SmoothingNone
+	}
+	if normalized.WeightPercent <= 0 || normalized.WeightPercent > 100 {
+		normalized.WeightPercent = provisioningv1alpha1.DefaultSmoothingWeightPercent
+	}
+	if normalized.Window <= 0 || normalized.Window > provisioningv1alpha1.MaxSmoothingWindow {
+		normalized.Window = provisioningv1alpha1.DefaultSmoothingWindow
+	}
+	return normalized
+}
+
+// newSmoother returns the smoother for the (normalized) smoothing of a graph, nil if measurements are used as they are
+func newSmoother(smoothing provisioningv1alpha1.Smoothing) smoother {
+	switch smoothing.Method {
+	case provisioningv1alpha1.SmoothingEWMA:
+		return &ewmaSmoother{weight: float64(smoothing.WeightPercent) / 100}
+	case provisioningv1alpha1.SmoothingWindowMean:
+		return &windowSmoother{size: int(smoothing.Window)}
+	case provisioningv1alpha1.SmoothingWindowMedian:
+		return &windowSmoother{size: int(smoothing.Window), median: true}
+	default:
+		return nil
+	}
+}
+
+// ewmaSmoother is an exponentially weighted moving average, starting from the first measurement
+type ewmaSmoother struct {
+	// weight of the latest measurement, in (0, 1]
+	weight      float64
+	value       float64
+	initialized bool
+}
+
+func (s *ewmaSmoother) Add(value float64) float64 {
+	if !s.initialized {
+		s.value = value
+		s.initialized = true
+	} else {
+		s.value = s.weight*value + (1-s.weight)*s.value
+	}
+	return s.value
+}
+
+func (s *ewmaSmoother) Value() (float64, bool) {
+	return s.value, s.initialized
+}
+
+// windowSmoother is the mean or the median of the latest measurements
+type windowSmoother struct {
+	size   int
+	median bool
+	values []float64
+}
+
+func (s *windowSmoother) Add(value float64) float64 {
+	s.values = append(s.values, value)
+	if len(s.values) > s.size {
+		s.values = s.values[len(s.values)-s.size:]
+	}
+	smoothed, _ := s.Value()
+	return smoothed
+}
+
+func (s *windowSmoother) Value() (float64, bool) {
+	if len(s.values) == 0 {
+		return 0, false
+	}
+
+	if s.median {
+		sorted := append([]float64{}, s.values...)
+		sort.Float64s(sorted)
+		middle := len(sorted) / 2
+		if len(sorted)%2 == 0 {
+			return (sorted[middle-1] + sorted[middle]) / 2, true
+		}
+		return sorted[middle], true
+	}
+
+	sum := 0.0
+	for _, value := range s.values {
+		sum += value
+	}
+	return sum / float64(len(s.values)), true
+}
@@ -0,0 +1,45 @@
+package aggregator
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	provisioningv1alpha1 "github.com/itspeetah/neptune-depdag-controller/api/v1alpha1"
+)
+
+var _ = Describe("Smoothing", func() {
+	add := func(s smoother, values ...float64) []float64 {
+		smoothed := []float64{}
+		for _, value := range values {
+			smoothed = append(smoothed, s.Add(value))
+		}
+		return smoothed
+	}
+
+	It("should fill in the defaults", func() {
+		Expect(normalizeSmoothing(nil)).To(Equal(provisioningv1alpha1.Smoothing{Method: provisioningv1alpha1.SmoothingNone}))
+		Expect(normalizeSmoothing(&provisioningv1alpha1.Smoothing{Method: provisioningv1alpha1.SmoothingEWMA})).To(Equal(provisioningv1alpha1.Smoothing{
+			Method:        provisioningv1alpha1.SmoothingEWMA,
+			WeightPercent: provisioningv1alpha1.DefaultSmoothingWeightPercent,
+			Window:        provisioningv1alpha1.DefaultSmoothingWindow,
+		}))
+		Expect(newSmoother(normalizeSmoothing(nil))).To(BeNil())
+	})
+
+	It("should start the EWMA from the first measurement", func() {
+		s := newSmoother(normalizeSmoothing(&provisioningv1alpha1.Smoothing{Method: provisioningv1alpha1.SmoothingEWMA, WeightPercent: 25}))
+		_, ok := s.Value()
+		Expect(ok).To(BeFalse())
+		Expect(add(s, 4, 8, 0)).To(Equal([]float64{4, 5, 3.75}))
+	})
+
+	It("should average the measurements in the window", func() {
+		s := newSmoother(normalizeSmoothing(&provisioningv1alpha1.Smoothing{Method: provisioningv1alpha1.SmoothingWindowMean, Window: 3}))
+		Expect(add(s, 3, 6, 9, 12)).To(Equal([]float64{3, 4.5, 6, 9}))
+	})
+
+	It("should take the median of the measurements in the window", func() {
+		s := newSmoother(normalizeSmoothing(&provisioningv1alpha1.Smoothing{Method: provisioningv1alpha1.SmoothingWindowMedian, Window: 3}))
+		Expect(add(s, 5, 1, 100, 2)).To(Equal([]float64{5, 3, 5, 2}))
+	})
+})
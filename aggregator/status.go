@@ -0,0 +1,225 @@
+package aggregator
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	provisioningv1alpha1 "github.com/itspeetah/neptune-depdag-controller/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// DefaultStatusUpdateInterval is how often the times in the status of a graph are refreshed at most,
+// unless its conditions change
+const DefaultStatusUpdateInterval = 30 * time.Second
+
+// StatusPublisher writes the times computed in the cycles in the status of the graph.
+// The times change on every cycle, so they are only written once every update interval, or when the conditions change:
+// the gauges and the custom metrics are there for the latest values.
+type StatusPublisher struct {
+	client client.Client
+	// updateInterval is the minimum time between two updates of the times of a graph, they are written on every cycle if zero
+	updateInterval time.Duration
+}
+
+func NewStatusPublisher(client client.Client, updateInterval time.Duration) *StatusPublisher {
+	return &StatusPublisher{client: client, updateInterval: updateInterval}
+}
+
+func (p *StatusPublisher) Publish(ctx context.Context, result *Result) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		graph := &DependencyGraph{}
+		if err := p.client.Get(ctx, result.Graph, graph); err != nil {
+			return err
+		}
+		previous := graph.Status.DeepCopy()
+		setNodeTimes(graph, result)
+		if !p.needsUpdate(previous, &graph.Status, result.Timestamp) {
+			return nil
+		}
+		return p.client.Status().Update(ctx, graph)
+	})
+}
+
+// needsUpdate tells if the new status must be written: when the conditions change, or the times were written longer than
+// the update interval ago
+func (p *StatusPublisher) needsUpdate(previous, current *provisioningv1alpha1.DependencyGraphStatus, now time.Time) bool {
+	if !equality.Semantic.DeepEqual(previous.Conditions, current.Conditions) || previous.LastAggregationTime == nil {
+		return true
+	}
+	return now.Sub(previous.LastAggregationTime.Time) >= p.updateInterval
+}
+
+// Retract does nothing, as the status goes away with the graph
+func (p *StatusPublisher) Retract(ctx context.Context, graph types.NamespacedName) error {
+	return nil
+}
+
+// setNodeTimes copies the times of the result in the node statuses and updates the conditions that depend on them
+func setNodeTimes(graph *DependencyGraph, result *Result) {
+	if result.TimedOut {
+		// Keep the times of the last complete cycle
+		meta.SetStatusCondition(&graph.Status.Conditions, metav1.Condition{
+			Type:               provisioningv1alpha1.ConditionMetricsAvailable,
+			Status:             metav1.ConditionFalse,
+			Reason:             "AggregationTimedOut",
+			Message:            "The last aggregation cycle timed out before every function was measured",
+			ObservedGeneration: graph.Generation,
+		})
+		SetReadyCondition(graph)
+		return
+	}
+
+	if result.PercentileUnsupported {
+		// The times are withdrawn everywhere else, the status must not keep them either
+		for i := range graph.Status.Nodes {
+			clearNodeTimes(&graph.Status.Nodes[i])
+		}
+		graph.Status.CriticalPaths = nil
+		meta.SetStatusCondition(&graph.Status.Conditions, metav1.Condition{
+			Type:               provisioningv1alpha1.ConditionMetricsAvailable,
+			Status:             metav1.ConditionFalse,
+			Reason:             "PercentileUnsupported",
+			Message:            "The graph selects a percentile, but the metrics source does not provide response time histograms",
+			ObservedGeneration: graph.Generation,
+		})
+		SetReadyCondition(graph)
+		return
+	}
+
+	lastAggregationTime := metav1.NewTime(result.Timestamp)
+	missingMetrics := []string{}
+	for _, function := range result.Functions {
+		nodeStatus := findNodeStatus(&graph.Status, function.Name)
+		nodeStatus.LastAggregationTime = &lastAggregationTime
+		nodeStatus.PodCount = int32(len(function.Pods))
+		clearNodeTimes(nodeStatus)
+		if function.Measured {
+			nodeStatus.LocalResponseTime = toDuration(function.ResponseTime)
+			nodeStatus.RawLocalResponseTime = toDuration(function.Raw.ResponseTime)
+		} else {
+			missingMetrics = append(missingMetrics, function.Name)
+		}
+		nodeStatus.ExternalResponseTime = toDuration(function.ExternalResponseTime)
+		nodeStatus.EndToEndResponseTime = toDuration(function.EndToEndResponseTime)
+		if function.Budget != nil {
+			nodeStatus.ResponseTimeTarget = toDuration(function.Budget.ResponseTime)
+			nodeStatus.EndToEndResponseTimeBudget = toDuration(function.Budget.EndToEnd)
+		}
+		if function.RequestRateKnown {
+			// Requests per second with millisecond precision
+			nodeStatus.ExpectedRequestRate = resource.NewMilliQuantity(int64(function.ExpectedRequestRate*1000), resource.DecimalSI)
+		}
+	}
+
+	graph.Status.CriticalPaths = make([]provisioningv1alpha1.CriticalPath, 0, len(result.CriticalPaths))
+	for _, path := range result.CriticalPaths {
+		steps := make([]provisioningv1alpha1.CriticalPathStep, 0, len(path.Steps))
+		for _, step := range path.Steps {
+			steps = append(steps, provisioningv1alpha1.CriticalPathStep{
+				FunctionName:      step.Function,
+				EdgeId:            step.EdgeId,
+				LocalResponseTime: toDuration(step.ResponseTime),
+			})
+		}
+		graph.Status.CriticalPaths = append(graph.Status.CriticalPaths, provisioningv1alpha1.CriticalPath{
+			EntryFunction:        path.Entry,
+			Steps:                steps,
+			Bottleneck:           path.Bottleneck,
+			EndToEndResponseTime: toDuration(path.EndToEndResponseTime),
+		})
+	}
+
+	graph.Status.LastAggregationTime = &lastAggregationTime
+
+	if len(missingMetrics) == 0 {
+		meta.SetStatusCondition(&graph.Status.Conditions, metav1.Condition{
+			Type:               provisioningv1alpha1.ConditionMetricsAvailable,
+			Status:             metav1.ConditionTrue,
+			Reason:             "MetricsAvailable",
+			Message:            "A response time was measured for every function",
+			ObservedGeneration: graph.Generation,
+		})
+	} else {
+		sort.Strings(missingMetrics)
+		meta.SetStatusCondition(&graph.Status.Conditions, metav1.Condition{
+			Type:               provisioningv1alpha1.ConditionMetricsAvailable,
+			Status:             metav1.ConditionFalse,
+			Reason:             "MissingMetrics",
+			Message:            fmt.Sprintf("No response time for functions: %s", strings.Join(missingMetrics, ", ")),
+			ObservedGeneration: graph.Generation,
+		})
+	}
+
+	SetReadyCondition(graph)
+}
+
+// SetReadyCondition sets the Ready condition of the graph from the other conditions in its status.
+// The graph is ready when it is acyclic, all of its services are resolved and all of its metrics are available.
+func SetReadyCondition(graph *DependencyGraph) {
+	for _, conditionType := range []string{
+		provisioningv1alpha1.ConditionAcyclic,
+		provisioningv1alpha1.ConditionServicesResolved,
+		provisioningv1alpha1.ConditionMetricsAvailable,
+	} {
+		condition := meta.FindStatusCondition(graph.Status.Conditions, conditionType)
+		if condition == nil || condition.Status != metav1.ConditionTrue {
+			reason := "Pending"
+			message := fmt.Sprintf("Condition %s is not known yet", conditionType)
+			if condition != nil {
+				reason = condition.Reason
+				message = condition.Message
+			}
+			meta.SetStatusCondition(&graph.Status.Conditions, metav1.Condition{
+				Type:               provisioningv1alpha1.ConditionReady,
+				Status:             metav1.ConditionFalse,
+				Reason:             reason,
+				Message:            message,
+				ObservedGeneration: graph.Generation,
+			})
+			return
+		}
+	}
+
+	meta.SetStatusCondition(&graph.Status.Conditions, metav1.Condition{
+		Type:               provisioningv1alpha1.ConditionReady,
+		Status:             metav1.ConditionTrue,
+		Reason:             "Aggregating",
+		Message:            "The times of every node are computed from measurements",
+		ObservedGeneration: graph.Generation,
+	})
+}
+
+// clearNodeTimes removes the times computed for the node, keeping what the reconciler resolved
+func clearNodeTimes(nodeStatus *provisioningv1alpha1.NodeStatus) {
+	nodeStatus.LocalResponseTime = nil
+	nodeStatus.RawLocalResponseTime = nil
+	nodeStatus.ExternalResponseTime = nil
+	nodeStatus.EndToEndResponseTime = nil
+	nodeStatus.ResponseTimeTarget = nil
+	nodeStatus.EndToEndResponseTimeBudget = nil
+	nodeStatus.ExpectedRequestRate = nil
+}
+
+// findNodeStatus returns the status of the node of the function, adding it if missing
+func findNodeStatus(status *provisioningv1alpha1.DependencyGraphStatus, functionName string) *provisioningv1alpha1.NodeStatus {
+	for i := range status.Nodes {
+		if status.Nodes[i].FunctionName == functionName {
+			return &status.Nodes[i]
+		}
+	}
+	status.Nodes = append(status.Nodes, provisioningv1alpha1.NodeStatus{FunctionName: functionName})
+	return &status.Nodes[len(status.Nodes)-1]
+}
+
+func toDuration(seconds float64) *metav1.Duration {
+	return &metav1.Duration{Duration: time.Duration(seconds * float64(time.Second))}
+}
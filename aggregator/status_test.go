@@ -0,0 +1,173 @@
+package aggregator
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	provisioningv1alpha1 "github.com/itspeetah/neptune-depdag-controller/api/v1alpha1"
+)
+
+var _ = Describe("Status", func() {
+	var graph *DependencyGraph
+
+	BeforeEach(func() {
+		graph = &DependencyGraph{}
+		graph.Status.Nodes = []provisioningv1alpha1.NodeStatus{{FunctionName: "A"}}
+		meta.SetStatusCondition(&graph.Status.Conditions, metav1.Condition{
+			Type: provisioningv1alpha1.ConditionAcyclic, Status: metav1.ConditionTrue, Reason: "Acyclic",
+		})
+		meta.SetStatusCondition(&graph.Status.Conditions, metav1.Condition{
+			Type: provisioningv1alpha1.ConditionServicesResolved, Status: metav1.ConditionTrue, Reason: "ServicesFound",
+		})
+	})
+
+	It("should report the node times and become ready when every function is measured", func() {
+		edgeId := int32(1)
+		setNodeTimes(graph, &Result{
+			Timestamp: time.Now(),
+			Functions: map[string]FunctionTimes{
+				"A": {Name: "A", Pods: []string{"a-1", "a-2"}, Measured: true, ResponseTime: 0.1, ExternalResponseTime: 0.25, EndToEndResponseTime: 0.35,
+					ExpectedRequestRate: 2.5, RequestRateKnown: true, Budget: &Budget{EndToEnd: 0.2, ResponseTime: 0.05}},
+				"B": {Name: "B", Pods: []string{"b-1"}, Measured: true, ResponseTime: 0.25},
+			},
+			CriticalPaths: []CriticalPath{{
+				Entry:                "A",
+				Steps:                []CriticalPathStep{{Function: "A", ResponseTime: 0.1}, {Function: "B", EdgeId: &edgeId, ResponseTime: 0.25}},
+				Bottleneck:           "B",
+				EndToEndResponseTime: 0.35,
+			}},
+		})
+
+		Expect(graph.Status.Nodes).To(HaveLen(2))
+		Expect(graph.Status.Nodes[0].PodCount).To(Equal(int32(2)))
+		Expect(graph.Status.Nodes[0].LocalResponseTime.Duration).To(Equal(100 * time.Millisecond))
+		Expect(graph.Status.Nodes[0].ExternalResponseTime.Duration).To(Equal(250 * time.Millisecond))
+		Expect(graph.Status.Nodes[0].EndToEndResponseTime.Duration).To(Equal(350 * time.Millisecond))
+		Expect(graph.Status.Nodes[0].ExpectedRequestRate.MilliValue()).To(Equal(int64(2500)))
+		Expect(graph.Status.Nodes[0].ResponseTimeTarget.Duration).To(Equal(50 * time.Millisecond))
+		Expect(graph.Status.Nodes[0].EndToEndResponseTimeBudget.Duration).To(Equal(200 * time.Millisecond))
+		Expect(graph.Status.Nodes[1].ResponseTimeTarget).To(BeNil())
+		// The request rate of B is not known, which is not the same as 0
+		Expect(graph.Status.Nodes[1].ExpectedRequestRate).To(BeNil())
+		Expect(graph.Status.CriticalPaths).To(Equal([]provisioningv1alpha1.CriticalPath{{
+			EntryFunction: "A",
+			Steps: []provisioningv1alpha1.CriticalPathStep{
+				{FunctionName: "A", LocalResponseTime: &metav1.Duration{Duration: 100 * time.Millisecond}},
+				{FunctionName: "B", EdgeId: &edgeId, LocalResponseTime: &metav1.Duration{Duration: 250 * time.Millisecond}},
+			},
+			Bottleneck:           "B",
+			EndToEndResponseTime: &metav1.Duration{Duration: 350 * time.Millisecond},
+		}}))
+		Expect(graph.Status.LastAggregationTime).NotTo(BeNil())
+		Expect(graph.Status.Nodes[0].LastAggregationTime).To(Equal(graph.Status.LastAggregationTime))
+		Expect(graph.Status.Nodes[1].LastAggregationTime).To(Equal(graph.Status.LastAggregationTime))
+		Expect(meta.IsStatusConditionTrue(graph.Status.Conditions, provisioningv1alpha1.ConditionMetricsAvailable)).To(BeTrue())
+		Expect(meta.IsStatusConditionTrue(graph.Status.Conditions, provisioningv1alpha1.ConditionReady)).To(BeTrue())
+	})
+
+	It("should report the functions without measurements", func() {
+		setNodeTimes(graph, &Result{
+			Timestamp: time.Now(),
+			Functions: map[string]FunctionTimes{
+				"A": {Name: "A", Measured: false},
+			},
+		})
+
+		Expect(graph.Status.Nodes[0].LocalResponseTime).To(BeNil())
+		condition := meta.FindStatusCondition(graph.Status.Conditions, provisioningv1alpha1.ConditionMetricsAvailable)
+		Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+		Expect(condition.Message).To(ContainSubstring("A"))
+		ready := meta.FindStatusCondition(graph.Status.Conditions, provisioningv1alpha1.ConditionReady)
+		Expect(ready.Status).To(Equal(metav1.ConditionFalse))
+		Expect(ready.Reason).To(Equal("MissingMetrics"))
+	})
+
+	It("should keep the node times of the last complete cycle when a cycle times out", func() {
+		graph.Status.Nodes[0].LocalResponseTime = &metav1.Duration{Duration: 100 * time.Millisecond}
+		setNodeTimes(graph, &Result{
+			Timestamp: time.Now(),
+			TimedOut:  true,
+			Functions: map[string]FunctionTimes{
+				"A": {Name: "A", Measured: false},
+			},
+		})
+
+		Expect(graph.Status.Nodes[0].LocalResponseTime.Duration).To(Equal(100 * time.Millisecond))
+		Expect(graph.Status.LastAggregationTime).To(BeNil())
+		condition := meta.FindStatusCondition(graph.Status.Conditions, provisioningv1alpha1.ConditionMetricsAvailable)
+		Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+		Expect(condition.Reason).To(Equal("AggregationTimedOut"))
+		Expect(meta.FindStatusCondition(graph.Status.Conditions, provisioningv1alpha1.ConditionReady).Reason).To(Equal("AggregationTimedOut"))
+	})
+
+	It("should clear the node times and not become ready when the percentile cannot be computed", func() {
+		graph.Status.Nodes[0].LocalResponseTime = &metav1.Duration{Duration: 100 * time.Millisecond}
+		graph.Status.Nodes[0].EndToEndResponseTime = &metav1.Duration{Duration: 100 * time.Millisecond}
+		setNodeTimes(graph, &Result{Timestamp: time.Now(), PercentileUnsupported: true})
+
+		Expect(graph.Status.Nodes[0].LocalResponseTime).To(BeNil())
+		Expect(graph.Status.Nodes[0].EndToEndResponseTime).To(BeNil())
+		condition := meta.FindStatusCondition(graph.Status.Conditions, provisioningv1alpha1.ConditionMetricsAvailable)
+		Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+		Expect(condition.Reason).To(Equal("PercentileUnsupported"))
+		Expect(meta.IsStatusConditionTrue(graph.Status.Conditions, provisioningv1alpha1.ConditionReady)).To(BeFalse())
+	})
+
+	It("should only write the times once per update interval, unless the conditions change", func() {
+		scheme := runtime.NewScheme()
+		Expect(provisioningv1alpha1.AddToScheme(scheme)).To(Succeed())
+		graph.Name, graph.Namespace = "graph", "status"
+		updates := 0
+		c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(graph).WithStatusSubresource(graph).
+			WithInterceptorFuncs(interceptor.Funcs{
+				SubResourceUpdate: func(ctx context.Context, c client.Client, subResourceName string, obj client.Object, opts ...client.SubResourceUpdateOption) error {
+					updates++
+					return c.SubResource(subResourceName).Update(ctx, obj, opts...)
+				},
+			}).Build()
+		ctx := context.Background()
+		publisher := NewStatusPublisher(c, time.Minute)
+		name := types.NamespacedName{Namespace: "status", Name: "graph"}
+		measured := func(timestamp time.Time, responseTime float64) *Result {
+			return &Result{Graph: name, Timestamp: timestamp, Functions: map[string]FunctionTimes{
+				"A": {Name: "A", Measured: true, ResponseTime: responseTime},
+			}}
+		}
+
+		start := time.Now()
+		Expect(publisher.Publish(ctx, measured(start, 0.1))).To(Succeed())
+		Expect(updates).To(Equal(1))
+
+		By("Publishing new times within the interval")
+		Expect(publisher.Publish(ctx, measured(start.Add(10*time.Second), 0.2))).To(Succeed())
+		Expect(updates).To(Equal(1))
+
+		By("Losing the metrics of a function")
+		Expect(publisher.Publish(ctx, &Result{Graph: name, Timestamp: start.Add(20 * time.Second), Functions: map[string]FunctionTimes{
+			"A": {Name: "A"},
+		}})).To(Succeed())
+		Expect(updates).To(Equal(2))
+
+		By("Publishing after the interval")
+		Expect(publisher.Publish(ctx, measured(start.Add(2*time.Minute), 0.3))).To(Succeed())
+		Expect(updates).To(Equal(3))
+		updated := &DependencyGraph{}
+		Expect(c.Get(ctx, name, updated)).To(Succeed())
+		Expect(updated.Status.Nodes[0].LocalResponseTime.Duration).To(Equal(300 * time.Millisecond))
+
+		By("Writing the times on every cycle without an update interval")
+		publisher = NewStatusPublisher(c, 0)
+		Expect(publisher.Publish(ctx, measured(start.Add(2*time.Minute+time.Second), 0.4))).To(Succeed())
+		Expect(updates).To(Equal(4))
+	})
+})
@@ -2,6 +2,72 @@ package aggregator
 
 import provisioningv1alpha1 "github.com/itspeetah/neptune-depdag-controller/api/v1alpha1"
 
+// DuplicateFunctions returns the functions declared by more than one node, in the declaration order.
+// The invocations of a graph with duplicates cannot be checked, nor its times computed.
+func DuplicateFunctions(nodes []provisioningv1alpha1.FunctionNode) []string {
+	declarations := make(map[string]int, len(nodes))
+	var duplicates []string
+	for _, node := range nodes {
+		declarations[node.FunctionName]++
+		if declarations[node.FunctionName] == 2 {
+			duplicates = append(duplicates, node.FunctionName)
+		}
+	}
+	return duplicates
+}
+
+// FindCycle returns the functions along a cycle of invocations (first and last being the same), or nil if the graph is acyclic
+func FindCycle(nodes []provisioningv1alpha1.FunctionNode) []string {
+	invocations := make(map[string][]string, len(nodes))
+	for _, node := range nodes {
+		for _, edge := range node.Invocations {
+			invocations[node.FunctionName] = append(invocations[node.FunctionName], edge.FunctionName)
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(nodes))
+	path := []string{}
+
+	var visit func(name string) []string
+	visit = func(name string) []string {
+		state[name] = visiting
+		path = append(path, name)
+		for _, invoked := range invocations[name] {
+			switch state[invoked] {
+			case visiting:
+				// The cycle starts where the invoked function first appears in the current path
+				for i, pathName := range path {
+					if pathName == invoked {
+						return append(append([]string{}, path[i:]...), invoked)
+					}
+				}
+			case unvisited:
+				if cycle := visit(invoked); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+		return nil
+	}
+
+	// Walk the nodes in the declaration order so that the reported cycle is stable
+	for _, node := range nodes {
+		if state[node.FunctionName] == unvisited {
+			if cycle := visit(node.FunctionName); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
+
 // I don't think this is particularly optimized, but it's not running often and the code that I got Gemini to generate for me was utter trash
 func sortNodesByDependencies(nodes []provisioningv1alpha1.FunctionNode) []provisioningv1alpha1.FunctionNode {
 
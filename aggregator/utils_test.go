@@ -0,0 +1,35 @@
+package aggregator
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	provisioningv1alpha1 "github.com/itspeetah/neptune-depdag-controller/api/v1alpha1"
+)
+
+var _ = Describe("Graph checks", func() {
+	invoking := func(name string, invoked ...string) provisioningv1alpha1.FunctionNode {
+		node := provisioningv1alpha1.FunctionNode{FunctionName: name}
+		for _, invokedName := range invoked {
+			node.Invocations = append(node.Invocations, provisioningv1alpha1.InvocationEdge{FunctionName: invokedName, EdgeMultiplier: 1})
+		}
+		return node
+	}
+
+	It("should find no cycle nor duplicate in a DAG", func() {
+		nodes := []provisioningv1alpha1.FunctionNode{invoking("a", "b", "c"), invoking("b", "c"), invoking("c")}
+		Expect(FindCycle(nodes)).To(BeNil())
+		Expect(DuplicateFunctions(nodes)).To(BeEmpty())
+	})
+
+	It("should return the path of a cycle", func() {
+		nodes := []provisioningv1alpha1.FunctionNode{invoking("a", "b"), invoking("b", "c"), invoking("c", "b")}
+		Expect(FindCycle(nodes)).To(Equal([]string{"b", "c", "b"}))
+	})
+
+	It("should report the functions declared more than once, and no cycle for them", func() {
+		nodes := []provisioningv1alpha1.FunctionNode{invoking("a", "b"), invoking("b"), invoking("b"), invoking("a"), invoking("b")}
+		Expect(DuplicateFunctions(nodes)).To(Equal([]string{"b", "a"}))
+		Expect(FindCycle(nodes)).To(BeNil())
+	})
+})
@@ -17,26 +17,125 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
 // NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
 
+// EdgeGroupScopeAnnotation selects how edge ids are grouped when aggregating the graph times.
+// Edge groups are scoped to their calling node by default; setting it to EdgeGroupScopeGraph restores the
+// deprecated behaviour where edges with the same id are aggregated together across the whole graph, and the time of a
+// group is added to the caller once for every invocation in it, so that existing graphs keep their times.
+const EdgeGroupScopeAnnotation = "provisioning.pgmp.me/edge-group-scope"
+
+const (
+	EdgeGroupScopeNode  = "node"
+	EdgeGroupScopeGraph = "graph"
+)
+
+// MinAggregationInterval is the shortest interval the times of a graph can be computed at
+const MinAggregationInterval = time.Second
+
+// MaxEdgeRetries is the highest number of retries of the invocations of an edge
+const MaxEdgeRetries = 10
+
+// EdgeKind is how the caller waits for the invocations of an edge.
+type EdgeKind string
+
+const (
+	// EdgeKindSync invocations are waited for by the caller, so they add to its response time.
+	EdgeKindSync EdgeKind = "Sync"
+	// EdgeKindAsync invocations are enqueued by the caller, which returns right away.
+	EdgeKindAsync EdgeKind = "Async"
+	// EdgeKindStream invocations are events the caller fans out to the function through a stream, without waiting for them.
+	EdgeKindStream EdgeKind = "Stream"
+)
+
 type InvocationEdge struct {
 	// FunctionName is the name of the invoked function, used as a pod/service selector. It should match the function name in another node in the graph.
 	FunctionName string `json:"functionName"`
-	// Id of the invocation. Edges with the same id are invoked concurrently, different ids imply the invocations happen sequentially.
+	// Id of the invocation. Edges of the same node with the same id are invoked concurrently, different ids imply the invocations happen sequentially.
+	// Ids are scoped to the calling node, so different nodes can reuse the same ids.
 	EdgeId int32 `json:"edgeId"`
 	// Multiplier describes how many invocations to this function are performed by the caller function.
 	EdgeMultiplier int32 `json:"edgeMultiplier"`
+	// Kind of the invocations. Only Sync invocations count toward the response time of the caller, while every kind
+	// counts toward the expected request rate of the function (see NodeStatus.ExpectedRequestRate). Defaults to Sync.
+	// +optional
+	Kind EdgeKind `json:"kind,omitempty"`
+	// Probability that the caller performs the invocations at all (e.g. only on a cache miss), from 0 to 1. Defaults to 1.
+	// +optional
+	Probability *resource.Quantity `json:"probability,omitempty"`
+	// ObservedProbability makes the aggregator use the number of invocations per call of the caller measured by the
+	// metrics source, instead of the multiplier and the probability. These are still used while there is no measurement.
+	// +optional
+	ObservedProbability bool `json:"observedProbability,omitempty"`
+	// Timeout after which the caller gives up on an invocation, which then counts as failed.
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+	// ErrorRate is the probability that an invocation fails (besides timing out), from 0 to 1. Defaults to 0.
+	// +optional
+	ErrorRate *resource.Quantity `json:"errorRate,omitempty"`
+	// Retries is how many times the caller retries a failed invocation, up to MaxEdgeRetries.
+	// +optional
+	Retries int32 `json:"retries,omitempty"`
+	// RetryBackoff is how long the caller waits before each retry.
+	// +optional
+	RetryBackoff *metav1.Duration `json:"retryBackoff,omitempty"`
 }
 
 type FunctionNode struct {
 	// FunctionName represents what function this node is assigned to and it is used as a selector for the pods running said function.
 	FunctionName string `json:"functionName"`
+	// Namespace where the function runs, overriding the functionNamespace of the graph.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
 	// Invocations is the list of out-edges from the node to invoked functions.
 	Invocations []InvocationEdge `json:"invocations"`
+	// ResponseTimeSLO is the end-to-end response time the function must meet, only allowed on the functions that no other
+	// function invokes synchronously. It is split into a response time target for every function the node waits for.
+	// +optional
+	ResponseTimeSLO *metav1.Duration `json:"responseTimeSLO,omitempty"`
+}
+
+// SmoothingMethod selects how the measured response times of a function are smoothed across aggregation cycles.
+type SmoothingMethod string
+
+const (
+	// SmoothingNone uses the response time measured in the latest cycle.
+	SmoothingNone SmoothingMethod = "None"
+	// SmoothingEWMA uses the exponentially weighted moving average of the measured response times.
+	SmoothingEWMA SmoothingMethod = "EWMA"
+	// SmoothingWindowMean uses the mean of the response times measured in the latest cycles.
+	SmoothingWindowMean SmoothingMethod = "WindowMean"
+	// SmoothingWindowMedian uses the median of the response times measured in the latest cycles.
+	SmoothingWindowMedian SmoothingMethod = "WindowMedian"
+)
+
+// Defaults and bounds of the smoothing parameters
+const (
+	DefaultSmoothingWeightPercent = 50
+	DefaultSmoothingWindow        = 5
+	MaxSmoothingWindow            = 100
+)
+
+// Smoothing configures how the measured response times of the functions are smoothed across aggregation cycles.
+type Smoothing struct {
+	// Method is the smoothing to apply. Defaults to None.
+	// +optional
+	Method SmoothingMethod `json:"method,omitempty"`
+	// WeightPercent is the weight of the latest measurement in the EWMA, from 1 to 100. Defaults to DefaultSmoothingWeightPercent.
+	// +optional
+	WeightPercent int32 `json:"weightPercent,omitempty"`
+	// Window is the number of cycles the WindowMean and WindowMedian methods look at, up to MaxSmoothingWindow.
+	// Defaults to DefaultSmoothingWindow.
+	// +optional
+	Window int32 `json:"window,omitempty"`
 }
 
 // DependencyGraphSpec defines the desired state of DependencyGraph.
@@ -44,21 +143,158 @@ type DependencyGraphSpec struct {
 	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 
+	// AggregationInterval is how often the times of the graph are computed, at least MinAggregationInterval.
+	// Defaults to the interval the controller is configured with.
+	// +optional
+	AggregationInterval *metav1.Duration `json:"aggregationInterval,omitempty"`
+
+	// Priority decides which graphs are aggregated first when more of them are due than the controller can aggregate at once.
+	// Higher values go first.
+	// +optional
+	Priority int32 `json:"priority,omitempty"`
+
+	// Percentile makes the times of the graph that percentile (e.g. 95 for p95) of the response times, from 1 to 99,
+	// computed from the latency histograms of the functions instead of their averages.
+	// Requires a metrics source that provides histograms, and cannot be combined with smoothing: with any other source
+	// no times are published, and MetricsAvailable is false with reason PercentileUnsupported.
+	// +optional
+	Percentile int32 `json:"percentile,omitempty"`
+
+	// Smoothing of the measured response times, so that autoscalers don't flap with every measurement.
+	// The times computed from the raw measurements are published too.
+	// +optional
+	Smoothing *Smoothing `json:"smoothing,omitempty"`
+
+	// FunctionNamespace is the namespace where the functions of the graph run (e.g. openfaas-fn).
+	// Defaults to the namespace of the graph.
+	// +optional
+	FunctionNamespace string `json:"functionNamespace,omitempty"`
+
 	// Nodes represents the collection of nodes in the graph
 	Nodes []FunctionNode `json:"nodes"`
 }
 
+// Condition types reported in the status of a DependencyGraph.
+const (
+	// ConditionReady is true when the times of every node are being computed from actual measurements.
+	ConditionReady = "Ready"
+	// ConditionServicesResolved is true when a Service exists for every function of the graph.
+	ConditionServicesResolved = "ServicesResolved"
+	// ConditionMetricsAvailable is true when a response time could be measured for every function in the last aggregation.
+	ConditionMetricsAvailable = "MetricsAvailable"
+	// ConditionAcyclic is true when the invocations between the nodes do not form a cycle,
+	// and unknown when a function is declared by more than one node.
+	ConditionAcyclic = "Acyclic"
+)
+
+// NodeStatus is what the controller computed for a node of the graph.
+type NodeStatus struct {
+	// FunctionName is the function of the node.
+	FunctionName string `json:"functionName"`
+	// Service is the Service that exposes the function, if it was found.
+	// +optional
+	Service *corev1.ObjectReference `json:"service,omitempty"`
+	// PodCount is the number of ready pods serving the function in the last aggregation.
+	// +optional
+	PodCount int32 `json:"podCount"`
+	// LocalResponseTime is the response time of the function in the last aggregation, smoothed if the graph says so.
+	// +optional
+	LocalResponseTime *metav1.Duration `json:"localResponseTime,omitempty"`
+	// RawLocalResponseTime is the response time measured for the function in the last aggregation, before smoothing.
+	// +optional
+	RawLocalResponseTime *metav1.Duration `json:"rawLocalResponseTime,omitempty"`
+	// ExternalResponseTime is the time the function spends waiting on the functions it invokes, computed in the last aggregation.
+	// +optional
+	ExternalResponseTime *metav1.Duration `json:"externalResponseTime,omitempty"`
+	// EndToEndResponseTime is the local response time of the function plus its external response time, computed in the last aggregation.
+	// +optional
+	EndToEndResponseTime *metav1.Duration `json:"endToEndResponseTime,omitempty"`
+	// ResponseTimeTarget is the response time the function itself should meet, its share of the SLOs of the graph.
+	// It is only set for the functions that the SLOs depend on.
+	// +optional
+	ResponseTimeTarget *metav1.Duration `json:"responseTimeTarget,omitempty"`
+	// EndToEndResponseTimeBudget is the share of the SLOs of the graph for the function and the ones it waits for.
+	// +optional
+	EndToEndResponseTimeBudget *metav1.Duration `json:"endToEndResponseTimeBudget,omitempty"`
+	// ExpectedRequestRate is the requests per second the function should receive, propagated from the request rate
+	// measured on the entry functions of the graph in the last aggregation.
+	// +optional
+	ExpectedRequestRate *resource.Quantity `json:"expectedRequestRate,omitempty"`
+	// LastAggregationTime is when the times of the node in the status were computed.
+	// It is not refreshed once the function leaves the graph or its aggregation stops.
+	// +optional
+	LastAggregationTime *metav1.Time `json:"lastAggregationTime,omitempty"`
+}
+
+// CriticalPathStep is a function along a critical path.
+type CriticalPathStep struct {
+	// FunctionName is the function of the step.
+	FunctionName string `json:"functionName"`
+	// EdgeId is the id of the group of invocations the previous function of the path invokes this one in.
+	// It is not set for the entry function.
+	// +optional
+	EdgeId *int32 `json:"edgeId,omitempty"`
+	// LocalResponseTime is the response time of the function itself.
+	// +optional
+	LocalResponseTime *metav1.Duration `json:"localResponseTime,omitempty"`
+}
+
+// CriticalPath is the chain of invocations that dominates the end-to-end response time of an entry function,
+// following the slowest group of invocations of every function down to a leaf.
+type CriticalPath struct {
+	// EntryFunction is the function the path starts from, which no other function of the graph invokes synchronously.
+	EntryFunction string `json:"entryFunction"`
+	// Steps are the functions of the path, starting from the entry function.
+	Steps []CriticalPathStep `json:"steps"`
+	// Bottleneck is the function of the path with the highest local response time, the first one to scale.
+	// +optional
+	Bottleneck string `json:"bottleneck,omitempty"`
+	// EndToEndResponseTime is the end-to-end response time of the entry function.
+	// +optional
+	EndToEndResponseTime *metav1.Duration `json:"endToEndResponseTime,omitempty"`
+}
+
 // DependencyGraphStatus defines the observed state of DependencyGraph.
 type DependencyGraphStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 
-	// Services that implement the functions described in this graph
-	// Services []corev1.ObjectReference `json:"services"` // TODO this might maybe be "corev1.Service"?
+	// ObservedGeneration is the generation of the spec the status refers to.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Nodes reports the state of every node of the graph.
+	// +listType=map
+	// +listMapKey=functionName
+	// +optional
+	Nodes []NodeStatus `json:"nodes,omitempty"`
+
+	// CriticalPaths are the critical paths of the entry functions of the graph, computed in the last aggregation.
+	// +listType=map
+	// +listMapKey=entryFunction
+	// +optional
+	CriticalPaths []CriticalPath `json:"criticalPaths,omitempty"`
+
+	// LastAggregationTime is when the times of the graph in the status were computed.
+	// They are refreshed once every --status-update-interval of the manager at most (30 seconds by default),
+	// unless the conditions change, so they can be older than the published metrics.
+	// +optional
+	LastAggregationTime *metav1.Time `json:"lastAggregationTime,omitempty"`
+
+	// Conditions represent the latest available observations of the graph state.
+	// +listType=map
+	// +listMapKey=type
+	// +patchStrategy=merge
+	// +patchMergeKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
 }
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+// +kubebuilder:printcolumn:name="Last Aggregation",type=date,JSONPath=`.status.lastAggregationTime`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // DependencyGraph is the Schema for the dependencygraphs API.
 type DependencyGraph struct {
@@ -69,6 +305,22 @@ type DependencyGraph struct {
 	Status DependencyGraphStatus `json:"status,omitempty"`
 }
 
+// IsSync reports whether the caller waits for the invocations of the edge.
+func (e InvocationEdge) IsSync() bool {
+	return e.Kind == "" || e.Kind == EdgeKindSync
+}
+
+// NodeNamespace returns the namespace where the function of the node runs.
+func (g *DependencyGraph) NodeNamespace(node FunctionNode) string {
+	if node.Namespace != "" {
+		return node.Namespace
+	}
+	if g.Spec.FunctionNamespace != "" {
+		return g.Spec.FunctionNamespace
+	}
+	return g.Namespace
+}
+
 // +kubebuilder:object:root=true
 
 // DependencyGraphList contains a list of DependencyGraph.
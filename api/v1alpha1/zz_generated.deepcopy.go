@@ -21,16 +21,70 @@ limitations under the License.
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CriticalPath) DeepCopyInto(out *CriticalPath) {
+	*out = *in
+	if in.Steps != nil {
+		in, out := &in.Steps, &out.Steps
+		*out = make([]CriticalPathStep, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.EndToEndResponseTime != nil {
+		in, out := &in.EndToEndResponseTime, &out.EndToEndResponseTime
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CriticalPath.
+func (in *CriticalPath) DeepCopy() *CriticalPath {
+	if in == nil {
+		return nil
+	}
+	out := new(CriticalPath)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CriticalPathStep) DeepCopyInto(out *CriticalPathStep) {
+	*out = *in
+	if in.EdgeId != nil {
+		in, out := &in.EdgeId, &out.EdgeId
+		*out = new(int32)
+		**out = **in
+	}
+	if in.LocalResponseTime != nil {
+		in, out := &in.LocalResponseTime, &out.LocalResponseTime
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CriticalPathStep.
+func (in *CriticalPathStep) DeepCopy() *CriticalPathStep {
+	if in == nil {
+		return nil
+	}
+	out := new(CriticalPathStep)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *DependencyGraph) DeepCopyInto(out *DependencyGraph) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DependencyGraph.
@@ -86,6 +140,16 @@ func (in *DependencyGraphList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *DependencyGraphSpec) DeepCopyInto(out *DependencyGraphSpec) {
 	*out = *in
+	if in.AggregationInterval != nil {
+		in, out := &in.AggregationInterval, &out.AggregationInterval
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.Smoothing != nil {
+		in, out := &in.Smoothing, &out.Smoothing
+		*out = new(Smoothing)
+		**out = **in
+	}
 	if in.Nodes != nil {
 		in, out := &in.Nodes, &out.Nodes
 		*out = make([]FunctionNode, len(*in))
@@ -108,6 +172,31 @@ func (in *DependencyGraphSpec) DeepCopy() *DependencyGraphSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *DependencyGraphStatus) DeepCopyInto(out *DependencyGraphStatus) {
 	*out = *in
+	if in.Nodes != nil {
+		in, out := &in.Nodes, &out.Nodes
+		*out = make([]NodeStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.CriticalPaths != nil {
+		in, out := &in.CriticalPaths, &out.CriticalPaths
+		*out = make([]CriticalPath, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.LastAggregationTime != nil {
+		in, out := &in.LastAggregationTime, &out.LastAggregationTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DependencyGraphStatus.
@@ -126,7 +215,14 @@ func (in *FunctionNode) DeepCopyInto(out *FunctionNode) {
 	if in.Invocations != nil {
 		in, out := &in.Invocations, &out.Invocations
 		*out = make([]InvocationEdge, len(*in))
-		copy(*out, *in)
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.ResponseTimeSLO != nil {
+		in, out := &in.ResponseTimeSLO, &out.ResponseTimeSLO
+		*out = new(v1.Duration)
+		**out = **in
 	}
 }
 
@@ -143,6 +239,26 @@ func (in *FunctionNode) DeepCopy() *FunctionNode {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *InvocationEdge) DeepCopyInto(out *InvocationEdge) {
 	*out = *in
+	if in.Probability != nil {
+		in, out := &in.Probability, &out.Probability
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.Timeout != nil {
+		in, out := &in.Timeout, &out.Timeout
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.ErrorRate != nil {
+		in, out := &in.ErrorRate, &out.ErrorRate
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.RetryBackoff != nil {
+		in, out := &in.RetryBackoff, &out.RetryBackoff
+		*out = new(v1.Duration)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InvocationEdge.
@@ -154,3 +270,77 @@ func (in *InvocationEdge) DeepCopy() *InvocationEdge {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NodeStatus) DeepCopyInto(out *NodeStatus) {
+	*out = *in
+	if in.Service != nil {
+		in, out := &in.Service, &out.Service
+		*out = new(corev1.ObjectReference)
+		**out = **in
+	}
+	if in.LocalResponseTime != nil {
+		in, out := &in.LocalResponseTime, &out.LocalResponseTime
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.RawLocalResponseTime != nil {
+		in, out := &in.RawLocalResponseTime, &out.RawLocalResponseTime
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.ExternalResponseTime != nil {
+		in, out := &in.ExternalResponseTime, &out.ExternalResponseTime
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.EndToEndResponseTime != nil {
+		in, out := &in.EndToEndResponseTime, &out.EndToEndResponseTime
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.ResponseTimeTarget != nil {
+		in, out := &in.ResponseTimeTarget, &out.ResponseTimeTarget
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.EndToEndResponseTimeBudget != nil {
+		in, out := &in.EndToEndResponseTimeBudget, &out.EndToEndResponseTimeBudget
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.ExpectedRequestRate != nil {
+		in, out := &in.ExpectedRequestRate, &out.ExpectedRequestRate
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.LastAggregationTime != nil {
+		in, out := &in.LastAggregationTime, &out.LastAggregationTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NodeStatus.
+func (in *NodeStatus) DeepCopy() *NodeStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(NodeStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Smoothing) DeepCopyInto(out *Smoothing) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Smoothing.
+func (in *Smoothing) DeepCopy() *Smoothing {
+	if in == nil {
+		return nil
+	}
+	out := new(Smoothing)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -21,6 +21,7 @@ import (
 	"flag"
 	"os"
 	"path/filepath"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -28,17 +29,23 @@ import (
 
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/discovery"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	custommetricsclient "k8s.io/metrics/pkg/client/custom_metrics"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/certwatcher"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/metrics/filters"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
+	"github.com/itspeetah/neptune-depdag-controller/aggregator"
 	provisioningv1alpha1 "github.com/itspeetah/neptune-depdag-controller/api/v1alpha1"
 	"github.com/itspeetah/neptune-depdag-controller/internal/controller"
+	"github.com/itspeetah/neptune-depdag-controller/internal/custommetrics"
+	webhookprovisioningv1alpha1 "github.com/itspeetah/neptune-depdag-controller/internal/webhook/v1alpha1"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -63,6 +70,19 @@ func main() {
 	var probeAddr string
 	var secureMetrics bool
 	var enableHTTP2 bool
+	var metricsSource string
+	var podResponseTimeMetric string
+	var prometheusAddress string
+	var prometheusQueries aggregator.PrometheusQueries
+	var prometheusQuantile float64
+	var customMetricsPort int
+	var customMetricsCertPath string
+	var publishKosmosTargets bool
+	var kosmosResponseTimeUnit time.Duration
+	var aggregationInterval time.Duration
+	var aggregationWorkers int
+	var aggregationTimeout time.Duration
+	var statusUpdateInterval time.Duration
 	var tlsOpts []func(*tls.Config)
 	flag.StringVar(&metricsAddr, "metrics-bind-address", "0", "The address the metrics endpoint binds to. "+
 		"Use :8443 for HTTPS or :8080 for HTTP, or leave as 0 to disable the metrics service.")
@@ -81,6 +101,48 @@ func main() {
 	flag.StringVar(&metricsCertKey, "metrics-cert-key", "tls.key", "The name of the metrics server key file.")
 	flag.BoolVar(&enableHTTP2, "enable-http2", false,
 		"If set, HTTP/2 will be enabled for the metrics and webhook servers")
+	flag.StringVar(&metricsSource, "metrics-source", "pods",
+		"Where function response times are read from: 'pods' (custom metrics API) or 'prometheus'.")
+	flag.StringVar(&podResponseTimeMetric, "pod-response-time-metric", aggregator.DefaultPodResponseTimeMetric,
+		"The custom metric read from each function pod to get its latest response time.")
+	flag.StringVar(&prometheusAddress, "prometheus-address", "http://prometheus.openfaas:9090",
+		"The address of the Prometheus HTTP API used by the 'prometheus' metrics source.")
+	flag.StringVar(&prometheusQueries.Mean, "prometheus-mean-query", aggregator.DefaultPrometheusMeanQuery,
+		"PromQL template returning the mean response time of a function ({{.Function}}, {{.Namespace}}).")
+	flag.StringVar(&prometheusQueries.Percentile, "prometheus-percentile-query", aggregator.DefaultPrometheusPercentileQuery,
+		"PromQL template returning a percentile of the response time of a function ({{.Function}}, {{.Namespace}}, {{.Quantile}}).")
+	flag.StringVar(&prometheusQueries.Histogram, "prometheus-histogram-query", aggregator.DefaultPrometheusHistogramQuery,
+		"PromQL template returning the buckets of the response time of a function by le ({{.Function}}, {{.Namespace}}), "+
+			"used by the graphs that aggregate a percentile.")
+	flag.StringVar(&prometheusQueries.RequestRate, "prometheus-request-rate-query", aggregator.DefaultPrometheusRequestRateQuery,
+		"PromQL template returning the requests per second of a function ({{.Function}}, {{.Namespace}}), "+
+			"measured on the entry functions of the graphs to compute the expected request rate of the others.")
+	flag.StringVar(&prometheusQueries.CallRatio, "prometheus-call-ratio-query", "",
+		"PromQL template returning how many times a function ({{.Function}}, {{.Namespace}}) invokes another one "+
+			"({{.Callee}}, {{.CalleeNamespace}}) per call, used by the edges with observedProbability. Disabled if empty.")
+	flag.Float64Var(&prometheusQuantile, "prometheus-quantile", 0,
+		"If greater than 0, the 'prometheus' metrics source reports this percentile (e.g. 0.95) instead of the mean.")
+	flag.IntVar(&customMetricsPort, "custom-metrics-secure-port", 0,
+		"The port the custom metrics API server serving external response times listens on. Leave as 0 to disable it. "+
+			"Requires --metrics-source=prometheus.")
+	flag.StringVar(&customMetricsCertPath, "custom-metrics-cert-path", "",
+		"The directory that contains the custom metrics API server certificate (tls.crt and tls.key). "+
+			"If empty, a self-signed certificate is generated.")
+	flag.BoolVar(&publishKosmosTargets, "publish-kosmos-targets", false,
+		"If set, the external response time of every function is subtracted from the response time target of the Kosmos "+
+			"ServiceLevelAgreements of the function, so that the recommender sizes it for its own time only.")
+	flag.DurationVar(&kosmosResponseTimeUnit, "kosmos-response-time-unit", aggregator.DefaultKosmosResponseTimeUnit,
+		"The unit of spec.metric.responseTime in the Kosmos ServiceLevelAgreements.")
+	flag.DurationVar(&aggregationInterval, "aggregation-interval", controller.DefaultAggregationInterval,
+		"How often the times of a graph are computed, unless the graph sets spec.aggregationInterval. "+
+			"Must be at least "+provisioningv1alpha1.MinAggregationInterval.String()+".")
+	flag.IntVar(&aggregationWorkers, "aggregation-workers", controller.DefaultAggregationWorkers,
+		"How many graphs can be aggregated at the same time.")
+	flag.DurationVar(&aggregationTimeout, "aggregation-timeout", 0,
+		"How long an aggregation cycle can run before it is reported as timed out. Leave as 0 to use the aggregation interval of the graph.")
+	flag.DurationVar(&statusUpdateInterval, "status-update-interval", aggregator.DefaultStatusUpdateInterval,
+		"How often the times of a graph are written in its status at most, unless its conditions change. "+
+			"Set to 0 to write them on every aggregation cycle.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -89,6 +151,23 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	if aggregationWorkers < 1 {
+		setupLog.Error(nil, "at least one aggregation worker is needed", "aggregation-workers", aggregationWorkers)
+		os.Exit(1)
+	}
+	if aggregationInterval < provisioningv1alpha1.MinAggregationInterval {
+		setupLog.Error(nil, "aggregation interval is too short", "aggregation-interval", aggregationInterval,
+			"minimum", provisioningv1alpha1.MinAggregationInterval)
+		os.Exit(1)
+	}
+	if customMetricsPort > 0 && metricsSource == "pods" {
+		// The pods source would read the response times from the custom metrics API server of the manager itself,
+		// which only serves the graph metrics
+		setupLog.Error(nil, "the custom metrics API server cannot be used with the pods metrics source",
+			"custom-metrics-secure-port", customMetricsPort, "metrics-source", metricsSource)
+		os.Exit(1)
+	}
+
 	// if the enable-http2 flag is false (the default), http/2 should be disabled
 	// due to its vulnerabilities. More specifically, disabling http/2 will
 	// prevent from being vulnerable to the HTTP/2 Stream Cancellation and
@@ -185,6 +264,8 @@ func main() {
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "02f569d7.pgmp.me",
+		// The Kosmos agreements are handled as unstructured objects, they are read from the cache like the typed ones
+		Client: client.Options{Cache: &client.CacheOptions{Unstructured: true}},
 		// LeaderElectionReleaseOnCancel defines if the leader should step down voluntarily
 		// when the Manager ends. This requires the binary to immediately end when the
 		// Manager is stopped, otherwise, this setting is unsafe. Setting this significantly
@@ -202,15 +283,70 @@ func main() {
 		os.Exit(1)
 	}
 
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(mgr.GetConfig())
+	if err != nil {
+		setupLog.Error(err, "unable to create discovery client")
+		os.Exit(1)
+	}
+	availableMetricsAPIs := custommetricsclient.NewAvailableAPIsGetter(discoveryClient)
+
+	var functionMetrics aggregator.MetricsSource
+	switch metricsSource {
+	case "pods":
+		customMetricsClient := custommetricsclient.NewForConfig(mgr.GetConfig(), mgr.GetRESTMapper(), availableMetricsAPIs)
+		functionMetrics = aggregator.NewPodMetricsSource(customMetricsClient, podResponseTimeMetric)
+	case "prometheus":
+		functionMetrics, err = aggregator.NewPrometheusMetricsSource(prometheusAddress, prometheusQueries, prometheusQuantile)
+		if err != nil {
+			setupLog.Error(err, "unable to create prometheus metrics source")
+			os.Exit(1)
+		}
+	default:
+		setupLog.Error(nil, "unknown metrics source", "metrics-source", metricsSource)
+		os.Exit(1)
+	}
+
+	publishers := []aggregator.Publisher{
+		aggregator.NewStatusPublisher(mgr.GetClient(), statusUpdateInterval),
+		aggregator.NewGaugePublisher(),
+	}
+	if publishKosmosTargets {
+		publishers = append(publishers, aggregator.NewKosmosPublisher(mgr.GetClient(), kosmosResponseTimeUnit))
+	}
+	if customMetricsPort > 0 {
+		customMetricsProvider := custommetrics.NewProvider(mgr.GetClient())
+		publishers = append(publishers, customMetricsProvider)
+
+		setupLog.Info("Adding custom metrics API server to manager", "port", customMetricsPort)
+		customMetricsAdapter := custommetrics.NewAdapter(customMetricsProvider, customMetricsPort, customMetricsCertPath)
+		if err := mgr.Add(customMetricsAdapter); err != nil {
+			setupLog.Error(err, "unable to add custom metrics API server to manager")
+			os.Exit(1)
+		}
+	}
+
 	reconciler := &controller.DependencyGraphReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:        mgr.GetClient(),
+		Scheme:        mgr.GetScheme(),
+		MetricsSource: functionMetrics,
+		Publishers:    publishers,
+
+		AggregationInterval: aggregationInterval,
+		AggregationWorkers:  aggregationWorkers,
+		AggregationTimeout:  aggregationTimeout,
 	}
 
 	if err = (reconciler).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "DependencyGraph")
 		os.Exit(1)
 	}
+	// nolint:goconst
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = webhookprovisioningv1alpha1.SetupDependencyGraphWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "DependencyGraph")
+			os.Exit(1)
+		}
+	}
 	// +kubebuilder:scaffold:builder
 
 	defer reconciler.StopGracefully()
@@ -239,9 +375,21 @@ func main() {
 		setupLog.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
+	if customMetricsPort > 0 {
+		// Only the leader has the times of the graphs, the other replicas are kept out of the custom metrics service
+		if err := mgr.AddReadyzCheck("custom-metrics", custommetrics.ElectedCheck(mgr.Elected())); err != nil {
+			setupLog.Error(err, "unable to set up custom metrics ready check")
+			os.Exit(1)
+		}
+	}
+
+	ctx := ctrl.SetupSignalHandler()
+
+	// Custom metrics API versions are cached by the client, refresh them in case the adapter gets updated
+	go custommetricsclient.PeriodicallyInvalidate(availableMetricsAPIs, 5*time.Minute, ctx.Done())
 
 	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	if err := mgr.Start(ctx); err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
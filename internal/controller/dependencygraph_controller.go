@@ -19,31 +19,64 @@ package controller
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	aggregator "github.com/itspeetah/neptune-depdag-controller/aggregator"
 	provisioningv1alpha1 "github.com/itspeetah/neptune-depdag-controller/api/v1alpha1"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 )
 
+// How long to wait before checking again for the services of a graph that are missing
+const missingServicesRequeueDelay = 30 * time.Second
+
+// DefaultAggregationInterval is how often the times of a graph are computed when neither the graph nor the manager say otherwise
+const DefaultAggregationInterval = 3 * time.Second
+
+// Every aggregation waits up to this fraction of the interval more, so that graphs created together don't query the metrics together
+const aggregationJitterFactor = 0.1
+
+// dependencyGraphFinalizer keeps a graph around until its aggregator is stopped and what it published is retracted
+const dependencyGraphFinalizer = "provisioning.pgmp.me/aggregator"
+
 // DependencyGraphReconciler reconciles a DependencyGraph object
 type DependencyGraphReconciler struct {
 	client.Client
 	Scheme    *runtime.Scheme
-	scheduled StopSignalTable
+	scheduled Scheduler
+
+	// MetricsSource is used by the aggregators to get the response time of the functions
+	MetricsSource aggregator.MetricsSource
+	// Publishers receive the times computed at every aggregation cycle
+	Publishers []aggregator.Publisher
+	// AggregationInterval is used for the graphs that don't set one, DefaultAggregationInterval if zero
+	AggregationInterval time.Duration
+	// AggregationWorkers is how many graphs can be aggregated at the same time, DefaultAggregationWorkers if zero
+	AggregationWorkers int
+	// AggregationTimeout is how long an aggregation cycle can run, the aggregation interval of the graph if zero
+	AggregationTimeout time.Duration
 }
 
 // +kubebuilder:rbac:groups=provisioning.pgmp.me,resources=dependencygraphs,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=provisioning.pgmp.me,resources=dependencygraphs/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=provisioning.pgmp.me,resources=dependencygraphs/finalizers,verbs=update
 
+// Functions can run in any namespace (spec.functionNamespace), so their services and pods are read cluster-wide
 // +kubebuilder:rbac:groups=core,resources=services;pods,verbs=get;list;watch;
+// +kubebuilder:rbac:groups=custom.metrics.k8s.io,resources=*,verbs=get;list
+// +kubebuilder:rbac:groups=systemautoscaler.polimi.it,resources=servicelevelagreements,verbs=get;list;watch;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -67,13 +100,8 @@ func (r *DependencyGraphReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 		if apierrors.IsNotFound(err) {
 			logger.Info("The DependencyGraph resource was not found. It must have been deleted.")
 
-			// Stop the goroutine handling this resource
-			// TODO Hook this up with finalizers
-			logger.Info(fmt.Sprintf("Stopping aggregator for graph %s...", req.NamespacedName))
-			r.scheduled.Delete(req.NamespacedName)
-			logger.Info(fmt.Sprintf("Stopped aggregator for graph %s...", req.NamespacedName))
-
-			return ctrl.Result{}, nil
+			// The finalizer normally cleans up before this point, this only matters if it was removed by someone else
+			return ctrl.Result{}, r.cleanup(ctx, req.NamespacedName)
 		}
 
 		// Error reading the object - requeue the request.
@@ -81,80 +109,240 @@ func (r *DependencyGraphReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 		return ctrl.Result{}, err
 	}
 
-	// List services matching specific labels
-	labeledServiceList := &corev1.ServiceList{}
-	err = r.List(ctx, labeledServiceList, client.InNamespace(depGraph.ObjectMeta.Namespace))
+	if !depGraph.DeletionTimestamp.IsZero() {
+		if !controllerutil.ContainsFinalizer(depGraph, dependencyGraphFinalizer) {
+			return ctrl.Result{}, nil
+		}
+		if err := r.cleanup(ctx, req.NamespacedName); err != nil {
+			return ctrl.Result{}, err
+		}
+		controllerutil.RemoveFinalizer(depGraph, dependencyGraphFinalizer)
+		if err := r.Update(ctx, depGraph); err != nil {
+			logger.Error(err, "Failed to remove the finalizer of the dependencygraph")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+
+	// A cycle can only be looked for once every function is declared by a single node
+	if duplicates := aggregator.DuplicateFunctions(depGraph.Spec.Nodes); len(duplicates) > 0 {
+		meta.SetStatusCondition(&depGraph.Status.Conditions, metav1.Condition{
+			Type:               provisioningv1alpha1.ConditionAcyclic,
+			Status:             metav1.ConditionUnknown,
+			Reason:             "DuplicateFunctions",
+			Message:            fmt.Sprintf("Functions declared by more than one node: %s", strings.Join(duplicates, ", ")),
+			ObservedGeneration: depGraph.Generation,
+		})
+	} else if cycle := aggregator.FindCycle(depGraph.Spec.Nodes); len(cycle) > 0 {
+		meta.SetStatusCondition(&depGraph.Status.Conditions, metav1.Condition{
+			Type:               provisioningv1alpha1.ConditionAcyclic,
+			Status:             metav1.ConditionFalse,
+			Reason:             "CycleDetected",
+			Message:            fmt.Sprintf("The invocations form a cycle, the graph times cannot be computed: %s", strings.Join(cycle, " -> ")),
+			ObservedGeneration: depGraph.Generation,
+		})
+	} else {
+		meta.SetStatusCondition(&depGraph.Status.Conditions, metav1.Condition{
+			Type:               provisioningv1alpha1.ConditionAcyclic,
+			Status:             metav1.ConditionTrue,
+			Reason:             "Acyclic",
+			Message:            "The invocations between the nodes form a DAG",
+			ObservedGeneration: depGraph.Generation,
+		})
+	}
+
+	// For every node check that a service exists
+	missingServices, err := r.resolveServices(ctx, depGraph)
 	if err != nil {
-		logger.Error(err, "failed to list services with labels")
+		// An unexpected error occurred: end and requeue reconciliation immediately
+		logger.Error(err, "Failed to resolve the services of the graph")
 		return ctrl.Result{}, err
 	}
-	logger.Info("found labeled services", "count", len(labeledServiceList.Items), "namespace", "another-namespace", "labels", "app=my-app")
-	for _, svc := range labeledServiceList.Items {
-		logger.Info("found labeled service", "name", svc.Name)
-	}
-
-	// // For every node check that at a service exists
-	// shouldRequeue := false
-	// for _, node := range depGraph.Spec.Nodes {
-	// 	service := &corev1.Service{}
-	// 	err := r.Get(ctx, types.NamespacedName{Name: node.FunctionName}, service)
-
-	// 	if err != nil {
-	// 		if apierrors.IsNotFound(err) {
-	// 			logger.Error(err, "Could not find service %s tracked by the dependency graph.", node.FunctionName)
-	// 			// If service is not found, keep walking through the graph just to log any other potentially missing services (?)
-	// 			shouldRequeue = true
-	// 			continue
-	// 		}
-	// 		// An unexpected error occurred: end and requeue reconciliation immediately
-	// 		logger.Error(err, "Failed to get service named %s", node.FunctionName)
-	// 		return ctrl.Result{}, err
-	// 	}
-	// }
-	// // If the reconciliation needs to be requeued, end and do so
-	// if shouldRequeue {
-	// 	return ctrl.Result{Requeue: true}, nil
-	// }
+	if len(missingServices) == 0 {
+		meta.SetStatusCondition(&depGraph.Status.Conditions, metav1.Condition{
+			Type:               provisioningv1alpha1.ConditionServicesResolved,
+			Status:             metav1.ConditionTrue,
+			Reason:             "ServicesFound",
+			Message:            "A service exists for every function of the graph",
+			ObservedGeneration: depGraph.Generation,
+		})
+	} else {
+		logger.Info("Could not find the services of some functions tracked by the dependency graph", "functions", missingServices)
+		meta.SetStatusCondition(&depGraph.Status.Conditions, metav1.Condition{
+			Type:               provisioningv1alpha1.ConditionServicesResolved,
+			Status:             metav1.ConditionFalse,
+			Reason:             "ServicesNotFound",
+			Message:            fmt.Sprintf("No service found for functions: %s", strings.Join(missingServices, ", ")),
+			ObservedGeneration: depGraph.Generation,
+		})
+	}
 
-	// Instantiate or update and re-instantiate the process that handles the graph (logic controller)
-	if _, ok := r.scheduled.Get(req.NamespacedName); ok {
-		// It was already scheduled so the resource has changed
-		// not sure if I need to do anything specific here
-		r.scheduled.Delete(req.NamespacedName)
+	depGraph.Status.ObservedGeneration = depGraph.Generation
+	aggregator.SetReadyCondition(depGraph)
+	if err := r.Status().Update(ctx, depGraph); err != nil {
+		logger.Error(err, "Failed to update dependencygraph status")
+		return ctrl.Result{}, err
 	}
 
-	// Schedule new goroutine
+	// The finalizer is added once the status is written, so that it reports what is wrong even if the update fails
+	if controllerutil.AddFinalizer(depGraph, dependencyGraphFinalizer) {
+		if err := r.Update(ctx, depGraph); err != nil {
+			logger.Error(err, "Failed to add the finalizer to the dependencygraph")
+			return ctrl.Result{}, err
+		}
+	}
 
+	if !meta.IsStatusConditionTrue(depGraph.Status.Conditions, provisioningv1alpha1.ConditionAcyclic) {
+		// Nothing can be computed until the spec is fixed, which will trigger a new reconciliation
+		logger.Info(fmt.Sprintf("Graph %s has a cycle or duplicate functions, not scheduling its aggregator.", req.NamespacedName))
+		r.scheduled.Remove(req.NamespacedName)
+		return ctrl.Result{}, nil
+	}
+
+	// Instantiate or update and re-instantiate the process that handles the graph (logic controller)
+	nodes := resolvedNodes(depGraph)
+	interval := r.aggregationInterval(depGraph)
+	if scheduled, ok := r.scheduled.Get(req.NamespacedName); ok && scheduled.Nodes == nodes && scheduled.Interval() == interval {
+		// Nothing that requires a restart has changed (e.g. a resync, a pod event or an edit of the edges or the smoothing):
+		// keep the running aggregator and its state, but hand over the latest version of the graph
+		scheduled.Aggregator.Update(depGraph)
+		r.scheduled.SetPriority(req.NamespacedName, depGraph.Spec.Priority)
+		logger.Info(fmt.Sprintf("Updated running aggregator for graph %s.", req.NamespacedName))
+		return r.requeueForServices(missingServices), nil
+	}
+
+	// The graph is new, or its nodes, their services or its interval changed: start from scratch, replacing the running
+	// aggregator if any
 	logger.Info(fmt.Sprintf("Scheduling aggregator for graph %s...", req.NamespacedName))
 
-	stopCh := make(chan struct{})
-	aggr := aggregator.NewAggregator(depGraph, r.Client)
-	go wait.Until(aggr.Aggregate, 3*time.Second, stopCh) // Set up proper config for how often this should run
-	r.scheduled.Set(req.NamespacedName, stopCh)
+	aggr := aggregator.NewAggregator(depGraph, r.Client, r.MetricsSource, r.Publishers...)
+	r.scheduled.Schedule(req.NamespacedName, aggr, interval, depGraph.Spec.Priority, nodes)
 
 	logger.Info(fmt.Sprintf("Scheduled aggregator for graph %s.", req.NamespacedName))
 
-	return ctrl.Result{}, nil
+	return r.requeueForServices(missingServices), nil
+}
+
+// cleanup stops the aggregator of the graph, waiting for it to exit, and retracts everything it published
+func (r *DependencyGraphReconciler) cleanup(ctx context.Context, graph types.NamespacedName) error {
+	logger := logf.FromContext(ctx)
+
+	// Stop the goroutine handling this resource
+	logger.Info(fmt.Sprintf("Stopping aggregator for graph %s...", graph))
+	r.scheduled.Remove(graph)
+	logger.Info(fmt.Sprintf("Stopped aggregator for graph %s...", graph))
+
+	// Autoscalers must not act on the values of a graph that does not exist anymore
+	for _, publisher := range r.Publishers {
+		if err := publisher.Retract(ctx, graph); err != nil {
+			logger.Error(err, "Failed to retract the times published for the graph")
+			return err
+		}
+	}
+	return nil
+}
+
+// aggregationInterval returns how often the times of the graph should be computed
+func (r *DependencyGraphReconciler) aggregationInterval(depGraph *provisioningv1alpha1.DependencyGraph) time.Duration {
+	interval := r.AggregationInterval
+	if depGraph.Spec.AggregationInterval != nil {
+		interval = depGraph.Spec.AggregationInterval.Duration
+	}
+	if interval == 0 {
+		interval = DefaultAggregationInterval
+	}
+	// The webhook rejects shorter intervals, but it might be disabled
+	return max(interval, provisioningv1alpha1.MinAggregationInterval)
+}
+
+// requeueForServices checks the graph again in a while if some of its services are missing, as they might be created later on
+func (r *DependencyGraphReconciler) requeueForServices(missingServices []string) ctrl.Result {
+	if len(missingServices) > 0 {
+		return ctrl.Result{RequeueAfter: missingServicesRequeueDelay}
+	}
+	return ctrl.Result{}
+}
+
+// resolvedNodes identifies the functions of the graph together with the services they resolved to,
+// so that a service being replaced is told apart from the graph being reconciled again
+func resolvedNodes(depGraph *provisioningv1alpha1.DependencyGraph) string {
+	nodes := make([]string, 0, len(depGraph.Status.Nodes))
+	for _, nodeStatus := range depGraph.Status.Nodes {
+		node := nodeStatus.FunctionName
+		if nodeStatus.Service != nil {
+			node += "=" + nodeStatus.Service.Namespace + "/" + nodeStatus.Service.Name + "/" + string(nodeStatus.Service.UID)
+		}
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return strings.Join(nodes, ",")
+}
+
+// resolveServices looks up the Service of every node, recording it in the node statuses, and returns the functions without one
+func (r *DependencyGraphReconciler) resolveServices(ctx context.Context, depGraph *provisioningv1alpha1.DependencyGraph) ([]string, error) {
+	missingServices := []string{}
+	nodeStatuses := make([]provisioningv1alpha1.NodeStatus, 0, len(depGraph.Spec.Nodes))
+	for _, node := range depGraph.Spec.Nodes {
+		// Keep what the aggregator computed for the nodes that are still in the graph
+		nodeStatus := provisioningv1alpha1.NodeStatus{FunctionName: node.FunctionName}
+		for _, previous := range depGraph.Status.Nodes {
+			if previous.FunctionName == node.FunctionName {
+				nodeStatus = previous
+				break
+			}
+		}
+
+		service := &corev1.Service{}
+		err := r.Get(ctx, types.NamespacedName{Namespace: depGraph.NodeNamespace(node), Name: node.FunctionName}, service)
+		if err != nil {
+			if !apierrors.IsNotFound(err) {
+				return nil, err
+			}
+			// If service is not found, keep walking through the graph to report any other missing service
+			missingServices = append(missingServices, node.FunctionName)
+			nodeStatus.Service = nil
+		} else {
+			nodeStatus.Service = &corev1.ObjectReference{
+				APIVersion: "v1",
+				Kind:       "Service",
+				Namespace:  service.Namespace,
+				Name:       service.Name,
+				UID:        service.UID,
+			}
+		}
+		nodeStatuses = append(nodeStatuses, nodeStatus)
+	}
+	depGraph.Status.Nodes = nodeStatuses
+	return missingServices, nil
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *DependencyGraphReconciler) SetupWithManager(mgr ctrl.Manager) error {
 
-	r.scheduled = *NewStopSignalTable()
+	r.scheduled.Workers = r.AggregationWorkers
+	r.scheduled.CycleTimeout = r.AggregationTimeout
+	if err := mgr.Add(&r.scheduled); err != nil {
+		return err
+	}
+
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &provisioningv1alpha1.DependencyGraph{},
+		functionIndexKey, indexGraphFunctions); err != nil {
+		return err
+	}
+
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&provisioningv1alpha1.DependencyGraph{}).
-		// Watches(
-		// 	&corev1.Service{},
-		// 	handler.EnqueueRequestsFromMapFunc(func(ctx context.Context, obj client.Object) []reconcile.Request {
-		// 		return []reconcile.Request{}
-		// 	}),
-		// ).
-		// Watches(
-		// 	&corev1.Pod{},
-		// 	handler.EnqueueRequestsFromMapFunc(func(ctx context.Context, obj client.Object) []reconcile.Request {
-		// 		return []reconcile.Request{}
-		// 	}),
-		// ).
+		// Status updates (e.g. from the aggregators) don't need a reconciliation
+		For(&provisioningv1alpha1.DependencyGraph{}, builder.WithPredicates(graphChangedPredicate())).
+		// Re-resolve the graphs of a function when its service or its ready pods change
+		Watches(
+			&corev1.Service{},
+			handler.EnqueueRequestsFromMapFunc(r.graphsForService),
+		).
+		Watches(
+			&corev1.Pod{},
+			handler.EnqueueRequestsFromMapFunc(r.graphsForPod),
+			builder.WithPredicates(podReadinessChangedPredicate()),
+		).
 		Named("dependencygraph").
 		Complete(r)
 }
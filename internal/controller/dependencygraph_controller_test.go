@@ -18,10 +18,12 @@ package controller
 
 import (
 	"context"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
@@ -65,6 +67,15 @@ var _ = Describe("DependencyGraph Controller", func() {
 
 			By("Cleanup the specific resource instance DependencyGraph")
 			Expect(k8sClient.Delete(ctx, resource)).To(Succeed())
+
+			By("Reconciling the deletion to run the finalizer")
+			controllerReconciler := &DependencyGraphReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+			}
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, typeNamespacedName, resource))).To(BeTrue())
 		})
 		It("should successfully reconcile the resource", func() {
 			By("Reconciling the created resource")
@@ -77,8 +88,110 @@ var _ = Describe("DependencyGraph Controller", func() {
 				NamespacedName: typeNamespacedName,
 			})
 			Expect(err).NotTo(HaveOccurred())
-			// TODO(user): Add more specific assertions depending on your controller's reconciliation logic.
-			// Example: If you expect a certain status condition after reconciliation, verify it here.
+
+			By("Checking the conditions reported in the status")
+			resource := &provisioningv1alpha1.DependencyGraph{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(meta.IsStatusConditionTrue(resource.Status.Conditions, provisioningv1alpha1.ConditionAcyclic)).To(BeTrue())
+			Expect(meta.IsStatusConditionTrue(resource.Status.Conditions, provisioningv1alpha1.ConditionServicesResolved)).To(BeTrue())
+			Expect(resource.Status.ObservedGeneration).To(Equal(resource.Generation))
+			Expect(resource.Finalizers).To(ContainElement(dependencyGraphFinalizer))
+		})
+
+		It("should only restart the aggregator when the graph changes", func() {
+			controllerReconciler := &DependencyGraphReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+			}
+			defer controllerReconciler.StopGracefully()
+
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			first, ok := controllerReconciler.scheduled.Get(typeNamespacedName)
+			Expect(ok).To(BeTrue())
+
+			By("Reconciling again without changes")
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			second, _ := controllerReconciler.scheduled.Get(typeNamespacedName)
+			Expect(second).To(BeIdenticalTo(first))
+
+			By("Changing the spec without touching the nodes or the interval")
+			resource := &provisioningv1alpha1.DependencyGraph{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			resource.Spec.Priority = 5
+			resource.Spec.Smoothing = &provisioningv1alpha1.Smoothing{Method: provisioningv1alpha1.SmoothingEWMA}
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			updated, _ := controllerReconciler.scheduled.Get(typeNamespacedName)
+			// The running aggregator keeps its smoothing state
+			Expect(updated).To(BeIdenticalTo(first))
+
+			By("Switching an existing graph to the legacy edge group scope")
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			resource.Annotations = map[string]string{provisioningv1alpha1.EdgeGroupScopeAnnotation: provisioningv1alpha1.EdgeGroupScopeGraph}
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			updated, _ = controllerReconciler.scheduled.Get(typeNamespacedName)
+			Expect(updated).To(BeIdenticalTo(first))
+
+			By("Changing the nodes")
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			resource.Spec.Nodes = []provisioningv1alpha1.FunctionNode{{FunctionName: "A", Invocations: []provisioningv1alpha1.InvocationEdge{}}}
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			third, _ := controllerReconciler.scheduled.Get(typeNamespacedName)
+			Expect(third).NotTo(BeIdenticalTo(first))
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(third.Nodes).To(Equal(resolvedNodes(resource)))
+		})
+
+		It("should not report a graph with duplicate functions as cyclic", func() {
+			controllerReconciler := &DependencyGraphReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+			}
+			defer controllerReconciler.StopGracefully()
+
+			// The webhook rejects duplicates, but it might be disabled
+			resource := &provisioningv1alpha1.DependencyGraph{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			resource.Spec.Nodes = []provisioningv1alpha1.FunctionNode{
+				{FunctionName: "A", Invocations: []provisioningv1alpha1.InvocationEdge{{FunctionName: "B", EdgeMultiplier: 1}}},
+				{FunctionName: "B", Invocations: []provisioningv1alpha1.InvocationEdge{}},
+				{FunctionName: "B", Invocations: []provisioningv1alpha1.InvocationEdge{}},
+			}
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			acyclic := meta.FindStatusCondition(resource.Status.Conditions, provisioningv1alpha1.ConditionAcyclic)
+			Expect(acyclic).NotTo(BeNil())
+			Expect(acyclic.Status).To(Equal(metav1.ConditionUnknown))
+			Expect(acyclic.Reason).To(Equal("DuplicateFunctions"))
+			Expect(acyclic.Message).To(ContainSubstring("B"))
+			_, scheduled := controllerReconciler.scheduled.Get(typeNamespacedName)
+			Expect(scheduled).To(BeFalse())
+		})
+	})
+	Context("When choosing the aggregation interval", func() {
+		It("should prefer the graph interval, then the manager one, within the minimum", func() {
+			controllerReconciler := &DependencyGraphReconciler{}
+			graph := &provisioningv1alpha1.DependencyGraph{}
+			Expect(controllerReconciler.aggregationInterval(graph)).To(Equal(DefaultAggregationInterval))
+
+			controllerReconciler.AggregationInterval = 10 * time.Second
+			Expect(controllerReconciler.aggregationInterval(graph)).To(Equal(10 * time.Second))
+
+			graph.Spec.AggregationInterval = &metav1.Duration{Duration: time.Minute}
+			Expect(controllerReconciler.aggregationInterval(graph)).To(Equal(time.Minute))
+
+			graph.Spec.AggregationInterval = &metav1.Duration{Duration: time.Millisecond}
+			Expect(controllerReconciler.aggregationInterval(graph)).To(Equal(provisioningv1alpha1.MinAggregationInterval))
 		})
 	})
 })
@@ -0,0 +1,299 @@
+package controller
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	aggregator "github.com/itspeetah/neptune-depdag-controller/aggregator"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// DefaultAggregationWorkers is how many aggregation cycles run at the same time when the scheduler doesn't say otherwise
+const DefaultAggregationWorkers = 4
+
+var (
+	schedulerQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "depdag_scheduler_queue_depth",
+		Help: "Number of graphs whose aggregation is due and waiting for a free worker",
+	})
+	schedulerBusyWorkers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "depdag_scheduler_busy_workers",
+		Help: "Number of workers running an aggregation cycle",
+	})
+	schedulerOverruns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "depdag_scheduler_overruns_total",
+		Help: "Number of aggregation cycles of a graph that ended more than one interval after they were due",
+	}, []string{"graph", "graph_namespace"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(schedulerQueueDepth, schedulerBusyWorkers, schedulerOverruns)
+}
+
+// ScheduledGraph is a graph whose aggregator is run periodically by the scheduler
+type ScheduledGraph struct {
+	Aggregator *aggregator.Aggregator
+	// Nodes identifies the resolved nodes of the graph when it was scheduled
+	Nodes string
+
+	name     types.NamespacedName
+	interval time.Duration
+	priority int32
+	// due is when the next cycle should start
+	due     time.Time
+	running bool
+	// cancel aborts the running cycle
+	cancel context.CancelFunc
+	// done is closed when the running cycle ends
+	done chan struct{}
+}
+
+// Scheduler runs the aggregators of the graphs on a bounded number of workers.
+// When more graphs are due than there are workers, the ones with the highest priority go first, then the ones due the earliest.
+// The next cycle of a graph is due one interval after the previous one ends, so a graph whose cycles take longer than
+// its interval slows down instead of piling up.
+// The zero value is ready to use and runs the cycles once started by the manager, on the leader only.
+type Scheduler struct {
+	// Workers is the maximum number of aggregation cycles running at the same time, DefaultAggregationWorkers if zero
+	Workers int
+	// CycleTimeout is how long an aggregation cycle can run, the interval of the graph if zero
+	CycleTimeout time.Duration
+
+	lock    sync.Mutex
+	entries map[types.NamespacedName]*ScheduledGraph
+	// wake is signalled when the entries change, so the dispatcher can look for the next due graph
+	wake chan struct{}
+}
+
+// init lazily initializes the scheduler, the caller must hold the lock
+func (s *Scheduler) init() {
+	if s.entries == nil {
+		s.entries = make(map[types.NamespacedName]*ScheduledGraph)
+		s.wake = make(chan struct{}, 1)
+	}
+}
+
+// signal wakes the dispatcher up, the caller must hold the lock
+func (s *Scheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Schedule starts running the aggregator of the graph, replacing the one it had. The first cycle is due right away.
+func (s *Scheduler) Schedule(name types.NamespacedName, aggr *aggregator.Aggregator, interval time.Duration, priority int32,
+	nodes string) *ScheduledGraph {
+	s.Remove(name)
+
+	entry := &ScheduledGraph{
+		Aggregator: aggr,
+		Nodes:      nodes,
+		name:       name,
+		interval:   interval,
+		priority:   priority,
+		due:        time.Now(),
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.init()
+	s.entries[name] = entry
+	s.signal()
+	return entry
+}
+
+// SetPriority changes the priority of the graph from its next cycle, if it is scheduled
+func (s *Scheduler) SetPriority(name types.NamespacedName, priority int32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if entry, ok := s.entries[name]; ok && entry.priority != priority {
+		entry.priority = priority
+		s.signal()
+	}
+}
+
+// Interval returns how often the aggregator of the graph runs
+func (g *ScheduledGraph) Interval() time.Duration {
+	return g.interval
+}
+
+// Get returns the graph if it is scheduled
+func (s *Scheduler) Get(name types.NamespacedName) (*ScheduledGraph, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	entry, ok := s.entries[name]
+	return entry, ok
+}
+
+// Remove stops running the aggregator of the graph, aborting the running cycle (if any) and waiting for it to end
+func (s *Scheduler) Remove(name types.NamespacedName) {
+	s.lock.Lock()
+	entry, ok := s.entries[name]
+	if !ok {
+		s.lock.Unlock()
+		return
+	}
+	delete(s.entries, name)
+	schedulerOverruns.DeleteLabelValues(name.Name, name.Namespace)
+	running, done := entry.running, entry.done
+	if running {
+		entry.cancel()
+	}
+	s.signal()
+	s.lock.Unlock()
+
+	if running {
+		<-done
+	}
+}
+
+// Clear removes every graph
+func (s *Scheduler) Clear() {
+	s.lock.Lock()
+	names := make([]types.NamespacedName, 0, len(s.entries))
+	for name := range s.entries {
+		names = append(names, name)
+	}
+	s.lock.Unlock()
+
+	for _, name := range names {
+		s.Remove(name)
+	}
+}
+
+var _ manager.LeaderElectionRunnable = &Scheduler{}
+
+// NeedLeaderElection makes the scheduler run on the leader only, so that a single replica publishes the times of a graph
+func (s *Scheduler) NeedLeaderElection() bool {
+	return true
+}
+
+// Start dispatches the due graphs to the workers until the context is done.
+// The context is done when the manager stops or loses leadership: every graph is then removed and the running cycles
+// waited for, since another replica might be publishing from then on.
+func (s *Scheduler) Start(ctx context.Context) error {
+	workers := s.Workers
+	if workers <= 0 {
+		workers = DefaultAggregationWorkers
+	}
+	s.lock.Lock()
+	s.init()
+	s.lock.Unlock()
+
+	var running sync.WaitGroup
+	defer func() {
+		s.Clear()
+		running.Wait()
+	}()
+
+	free := make(chan struct{}, workers)
+	for {
+		// Backpressure: due graphs wait in the queue until a worker is free
+		select {
+		case free <- struct{}{}:
+		case <-ctx.Done():
+			return nil
+		}
+
+		entry, cycleCtx := s.next(ctx)
+		if entry == nil {
+			return nil
+		}
+
+		running.Add(1)
+		schedulerBusyWorkers.Inc()
+		go func() {
+			defer running.Done()
+			defer func() { <-free }()
+			defer schedulerBusyWorkers.Dec()
+			s.run(cycleCtx, entry)
+		}()
+	}
+}
+
+// next waits for a graph to be due and marks it as running, returning the context of its cycle.
+// It returns nil when the context is done.
+func (s *Scheduler) next(ctx context.Context) (*ScheduledGraph, context.Context) {
+	for {
+		s.lock.Lock()
+		now := time.Now()
+		var next *ScheduledGraph
+		var nextDue time.Time
+		queued := 0
+		for _, entry := range s.entries {
+			if entry.running {
+				continue
+			}
+			if entry.due.After(now) {
+				if nextDue.IsZero() || entry.due.Before(nextDue) {
+					nextDue = entry.due
+				}
+				continue
+			}
+			queued++
+			if next == nil || entry.priority > next.priority || (entry.priority == next.priority && entry.due.Before(next.due)) {
+				next = entry
+			}
+		}
+		var cycleCtx context.Context
+		if next != nil {
+			timeout := s.CycleTimeout
+			if timeout <= 0 {
+				timeout = next.interval
+			}
+			cycleCtx, next.cancel = context.WithTimeout(ctx, timeout)
+			next.running = true
+			next.done = make(chan struct{})
+			queued--
+		}
+		schedulerQueueDepth.Set(float64(queued))
+		s.lock.Unlock()
+
+		if next != nil {
+			return next, cycleCtx
+		}
+
+		var timer *time.Timer
+		var timerC <-chan time.Time
+		if !nextDue.IsZero() {
+			timer = time.NewTimer(time.Until(nextDue))
+			timerC = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-s.wake:
+		case <-timerC:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+	}
+}
+
+// run runs a cycle of the graph and schedules the next one
+func (s *Scheduler) run(ctx context.Context, entry *ScheduledGraph) {
+	entry.Aggregator.Aggregate(ctx)
+	end := time.Now()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// Removed graphs are not counted anymore
+	if s.entries[entry.name] == entry && end.Sub(entry.due) > entry.interval {
+		schedulerOverruns.WithLabelValues(entry.name.Name, entry.name.Namespace).Inc()
+	}
+	entry.running = false
+	entry.cancel()
+	// Jitter spreads the graphs scheduled together, so they don't query the metrics together
+	entry.due = end.Add(wait.Jitter(entry.interval, aggregationJitterFactor))
+	close(entry.done)
+	s.signal()
+}
@@ -0,0 +1,199 @@
+package controller
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	aggregator "github.com/itspeetah/neptune-depdag-controller/aggregator"
+	provisioningv1alpha1 "github.com/itspeetah/neptune-depdag-controller/api/v1alpha1"
+)
+
+// noMetrics is a metrics source without any measurement
+type noMetrics struct{}
+
+func (noMetrics) ResponseTime(ctx context.Context, function aggregator.Function) (float64, error) {
+	return 0, aggregator.ErrNoMetrics
+}
+
+// recordingPublisher records the graphs it is asked to publish and the highest number of concurrent cycles
+type recordingPublisher struct {
+	delay   time.Duration
+	release chan struct{}
+
+	lock      sync.Mutex
+	running   int
+	maxActive int
+	published []types.NamespacedName
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, result *aggregator.Result) error {
+	p.lock.Lock()
+	p.running++
+	p.maxActive = max(p.maxActive, p.running)
+	p.lock.Unlock()
+
+	time.Sleep(p.delay)
+	if p.release != nil {
+		<-p.release
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.running--
+	p.published = append(p.published, result.Graph)
+	return nil
+}
+
+func (p *recordingPublisher) Retract(ctx context.Context, graph types.NamespacedName) error {
+	return nil
+}
+
+func (p *recordingPublisher) MaxActive() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.maxActive
+}
+
+func (p *recordingPublisher) Running() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.running
+}
+
+func (p *recordingPublisher) Published() []types.NamespacedName {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]types.NamespacedName{}, p.published...)
+}
+
+var _ = Describe("Scheduler", func() {
+	var (
+		schedulerCtx    context.Context
+		stopScheduler   context.CancelFunc
+		schedulerResult chan error
+	)
+
+	newAggregator := func(name types.NamespacedName, publisher aggregator.Publisher) *aggregator.Aggregator {
+		graph := &provisioningv1alpha1.DependencyGraph{ObjectMeta: metav1.ObjectMeta{Namespace: name.Namespace, Name: name.Name}}
+		return aggregator.NewAggregator(graph, nil, noMetrics{}, publisher)
+	}
+
+	start := func(s *Scheduler) {
+		schedulerResult = make(chan error, 1)
+		go func() { schedulerResult <- s.Start(schedulerCtx) }()
+	}
+
+	BeforeEach(func() {
+		schedulerCtx, stopScheduler = context.WithCancel(context.Background())
+		schedulerResult = nil
+	})
+
+	AfterEach(func() {
+		stopScheduler()
+		if schedulerResult != nil {
+			Eventually(schedulerResult).Should(Receive(BeNil()))
+		}
+	})
+
+	It("should run every graph periodically on a bounded number of workers", func() {
+		s := &Scheduler{Workers: 2}
+		publisher := &recordingPublisher{delay: 20 * time.Millisecond}
+		for _, name := range []string{"a", "b", "c", "d"} {
+			graph := types.NamespacedName{Namespace: "scheduler", Name: name}
+			s.Schedule(graph, newAggregator(graph, publisher), 10*time.Millisecond, 0, "")
+		}
+		start(s)
+
+		Eventually(func() []types.NamespacedName { return publisher.Published() }).Should(ContainElements(
+			types.NamespacedName{Namespace: "scheduler", Name: "a"},
+			types.NamespacedName{Namespace: "scheduler", Name: "b"},
+			types.NamespacedName{Namespace: "scheduler", Name: "c"},
+			types.NamespacedName{Namespace: "scheduler", Name: "d"},
+		))
+		Eventually(func() int { return len(publisher.Published()) }).Should(BeNumerically(">", 8))
+		Expect(publisher.MaxActive()).To(Equal(2))
+	})
+
+	It("should run the graphs with the highest priority first", func() {
+		s := &Scheduler{Workers: 1}
+		publisher := &recordingPublisher{}
+		low := types.NamespacedName{Namespace: "scheduler", Name: "low"}
+		high := types.NamespacedName{Namespace: "scheduler", Name: "high"}
+		s.Schedule(low, newAggregator(low, publisher), time.Hour, 0, "")
+		s.Schedule(high, newAggregator(high, publisher), time.Hour, 10, "")
+		start(s)
+
+		Eventually(func() []types.NamespacedName { return publisher.Published() }).Should(Equal([]types.NamespacedName{high, low}))
+	})
+
+	It("should apply the priority changes of a scheduled graph", func() {
+		s := &Scheduler{Workers: 1}
+		publisher := &recordingPublisher{}
+		low := types.NamespacedName{Namespace: "scheduler", Name: "low"}
+		high := types.NamespacedName{Namespace: "scheduler", Name: "high"}
+		s.Schedule(low, newAggregator(low, publisher), time.Hour, 0, "")
+		s.Schedule(high, newAggregator(high, publisher), time.Hour, 10, "")
+		s.SetPriority(low, 20)
+		start(s)
+
+		Eventually(func() []types.NamespacedName { return publisher.Published() }).Should(Equal([]types.NamespacedName{low, high}))
+	})
+
+	It("should wait for the running cycle when a graph is removed", func() {
+		s := &Scheduler{Workers: 1}
+		publisher := &recordingPublisher{release: make(chan struct{})}
+		graph := types.NamespacedName{Namespace: "scheduler", Name: "removed"}
+		s.Schedule(graph, newAggregator(graph, publisher), time.Hour, 0, "")
+		start(s)
+		Eventually(publisher.Running).Should(Equal(1))
+
+		removed := make(chan struct{})
+		go func() {
+			s.Remove(graph)
+			close(removed)
+		}()
+		Consistently(removed, 50*time.Millisecond).ShouldNot(BeClosed())
+
+		close(publisher.release)
+		Eventually(removed).Should(BeClosed())
+		_, ok := s.Get(graph)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should count the cycles that overrun their interval", func() {
+		s := &Scheduler{Workers: 1}
+		publisher := &recordingPublisher{delay: 20 * time.Millisecond}
+		graph := types.NamespacedName{Namespace: "scheduler", Name: "slow"}
+		s.Schedule(graph, newAggregator(graph, publisher), 5*time.Millisecond, 0, "")
+		start(s)
+
+		Eventually(func() float64 {
+			return testutil.ToFloat64(schedulerOverruns.WithLabelValues("slow", "scheduler"))
+		}).Should(BeNumerically(">", 0))
+	})
+
+	It("should stop every graph when its context is done, as when leadership is lost", func() {
+		s := &Scheduler{Workers: 1}
+		Expect(s.NeedLeaderElection()).To(BeTrue())
+		publisher := &recordingPublisher{delay: 50 * time.Millisecond}
+		graph := types.NamespacedName{Namespace: "scheduler", Name: "leader"}
+		s.Schedule(graph, newAggregator(graph, publisher), time.Hour, 0, "")
+		start(s)
+		Eventually(publisher.Running).Should(Equal(1))
+
+		stopScheduler()
+		Eventually(schedulerResult).Should(Receive(BeNil()))
+		schedulerResult = nil
+		// The running cycle ended before Start returned
+		Expect(publisher.Running()).To(Equal(0))
+		_, ok := s.Get(graph)
+		Expect(ok).To(BeFalse())
+	})
+})
@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"context"
+
+	aggregator "github.com/itspeetah/neptune-depdag-controller/aggregator"
+	provisioningv1alpha1 "github.com/itspeetah/neptune-depdag-controller/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// functionIndexKey indexes the graphs by the functions of their nodes, as namespace/name
+const functionIndexKey = ".spec.nodes.function"
+
+// indexGraphFunctions returns the functions referenced by a graph, in the namespaces where they run
+func indexGraphFunctions(obj client.Object) []string {
+	graph, ok := obj.(*provisioningv1alpha1.DependencyGraph)
+	if !ok {
+		return nil
+	}
+	functions := make([]string, 0, len(graph.Spec.Nodes))
+	for _, node := range graph.Spec.Nodes {
+		functions = append(functions, types.NamespacedName{Namespace: graph.NodeNamespace(node), Name: node.FunctionName}.String())
+	}
+	return functions
+}
+
+// graphsForFunctions returns a request for every graph that references one of the functions
+func (r *DependencyGraphReconciler) graphsForFunctions(ctx context.Context, functions ...types.NamespacedName) []reconcile.Request {
+	requests := []reconcile.Request{}
+	seen := make(map[types.NamespacedName]bool)
+	for _, function := range functions {
+		graphList := &provisioningv1alpha1.DependencyGraphList{}
+		if err := r.List(ctx, graphList, client.MatchingFields{functionIndexKey: function.String()}); err != nil {
+			logf.FromContext(ctx).Error(err, "Failed to list the graphs of a function", "function", function)
+			continue
+		}
+		for _, graph := range graphList.Items {
+			name := types.NamespacedName{Namespace: graph.Namespace, Name: graph.Name}
+			if !seen[name] {
+				seen[name] = true
+				requests = append(requests, reconcile.Request{NamespacedName: name})
+			}
+		}
+	}
+	return requests
+}
+
+// graphsForService maps a Service to the graphs of the function it exposes
+func (r *DependencyGraphReconciler) graphsForService(ctx context.Context, obj client.Object) []reconcile.Request {
+	return r.graphsForFunctions(ctx, types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()})
+}
+
+// graphsForPod maps a Pod to the graphs of the functions whose Service selects it
+func (r *DependencyGraphReconciler) graphsForPod(ctx context.Context, obj client.Object) []reconcile.Request {
+	serviceList := &corev1.ServiceList{}
+	if err := r.List(ctx, serviceList, client.InNamespace(obj.GetNamespace())); err != nil {
+		logf.FromContext(ctx).Error(err, "Failed to list the services of a pod", "pod", client.ObjectKeyFromObject(obj))
+		return nil
+	}
+
+	functions := []types.NamespacedName{}
+	for _, service := range serviceList.Items {
+		// Same rule as the aggregator: a service without selector does not select any pod
+		if len(service.Spec.Selector) == 0 {
+			continue
+		}
+		if labels.SelectorFromSet(service.Spec.Selector).Matches(labels.Set(obj.GetLabels())) {
+			functions = append(functions, types.NamespacedName{Namespace: service.Namespace, Name: service.Name})
+		}
+	}
+	return r.graphsForFunctions(ctx, functions...)
+}
+
+// graphChangedPredicate lets through the graph events that change what the aggregator computes: the spec and the
+// annotations (e.g. the edge group scope), ignoring the status updates of the aggregators
+func graphChangedPredicate() predicate.Predicate {
+	return predicate.Or(predicate.GenerationChangedPredicate{}, predicate.AnnotationChangedPredicate{})
+}
+
+// podReadinessChangedPredicate lets through the pod events that change the pods a function is served by,
+// ignoring the frequent status updates that do not affect readiness
+func podReadinessChangedPredicate() predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			oldPod, ok := e.ObjectOld.(*corev1.Pod)
+			if !ok {
+				return false
+			}
+			newPod, ok := e.ObjectNew.(*corev1.Pod)
+			if !ok {
+				return false
+			}
+			return aggregator.IsPodReady(oldPod) != aggregator.IsPodReady(newPod) ||
+				!labels.Equals(oldPod.Labels, newPod.Labels)
+		},
+	}
+}
@@ -0,0 +1,101 @@
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	provisioningv1alpha1 "github.com/itspeetah/neptune-depdag-controller/api/v1alpha1"
+)
+
+var _ = Describe("DependencyGraph watches", func() {
+	ctx := context.Background()
+	var r *DependencyGraphReconciler
+
+	request := func(namespace, name string) reconcile.Request {
+		return reconcile.Request{NamespacedName: types.NamespacedName{Namespace: namespace, Name: name}}
+	}
+
+	BeforeEach(func() {
+		scheme := runtime.NewScheme()
+		Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+		Expect(provisioningv1alpha1.AddToScheme(scheme)).To(Succeed())
+
+		client := fake.NewClientBuilder().WithScheme(scheme).
+			WithIndex(&provisioningv1alpha1.DependencyGraph{}, functionIndexKey, indexGraphFunctions).
+			WithObjects(
+				&provisioningv1alpha1.DependencyGraph{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "control", Name: "shop"},
+					Spec: provisioningv1alpha1.DependencyGraphSpec{
+						FunctionNamespace: "fn",
+						Nodes: []provisioningv1alpha1.FunctionNode{
+							{FunctionName: "frontend"},
+							{FunctionName: "database", Namespace: "data"},
+						},
+					},
+				},
+				&provisioningv1alpha1.DependencyGraph{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "fn", Name: "blog"},
+					Spec: provisioningv1alpha1.DependencyGraphSpec{
+						Nodes: []provisioningv1alpha1.FunctionNode{{FunctionName: "frontend"}},
+					},
+				},
+				&corev1.Service{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "fn", Name: "frontend"},
+					Spec:       corev1.ServiceSpec{Selector: map[string]string{"faas_function": "frontend"}},
+				},
+				&corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "fn", Name: "headless"}},
+			).Build()
+		r = &DependencyGraphReconciler{Client: client, Scheme: scheme}
+	})
+
+	It("should enqueue the graphs that reference the function of a service", func() {
+		Expect(r.graphsForService(ctx, &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "fn", Name: "frontend"}})).
+			To(ConsistOf(request("control", "shop"), request("fn", "blog")))
+		Expect(r.graphsForService(ctx, &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "data", Name: "database"}})).
+			To(ConsistOf(request("control", "shop")))
+		Expect(r.graphsForService(ctx, &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "fn", Name: "database"}})).
+			To(BeEmpty())
+	})
+
+	It("should enqueue the graphs of the functions whose service selects a pod", func() {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "fn", Name: "frontend-1", Labels: map[string]string{"faas_function": "frontend"}}}
+		Expect(r.graphsForPod(ctx, pod)).To(ConsistOf(request("control", "shop"), request("fn", "blog")))
+
+		pod.Labels = map[string]string{"faas_function": "other"}
+		Expect(r.graphsForPod(ctx, pod)).To(BeEmpty())
+	})
+
+	It("should let through the graph updates that change the spec or the annotations, not the status", func() {
+		oldGraph := &provisioningv1alpha1.DependencyGraph{ObjectMeta: metav1.ObjectMeta{Generation: 1}}
+		newGraph := oldGraph.DeepCopy()
+		newGraph.Status.ObservedGeneration = 1
+		Expect(graphChangedPredicate().Update(event.UpdateEvent{ObjectOld: oldGraph, ObjectNew: newGraph})).To(BeFalse())
+
+		newGraph.Annotations = map[string]string{provisioningv1alpha1.EdgeGroupScopeAnnotation: provisioningv1alpha1.EdgeGroupScopeGraph}
+		Expect(graphChangedPredicate().Update(event.UpdateEvent{ObjectOld: oldGraph, ObjectNew: newGraph})).To(BeTrue())
+
+		newGraph = oldGraph.DeepCopy()
+		newGraph.Generation = 2
+		Expect(graphChangedPredicate().Update(event.UpdateEvent{ObjectOld: oldGraph, ObjectNew: newGraph})).To(BeTrue())
+	})
+
+	It("should only let through the pod updates that change readiness or labels", func() {
+		oldPod := &corev1.Pod{Status: corev1.PodStatus{Phase: corev1.PodRunning}}
+		newPod := oldPod.DeepCopy()
+		newPod.Status.PodIP = "10.0.0.1"
+		Expect(podReadinessChangedPredicate().Update(event.UpdateEvent{ObjectOld: oldPod, ObjectNew: newPod})).To(BeFalse())
+
+		newPod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+		Expect(podReadinessChangedPredicate().Update(event.UpdateEvent{ObjectOld: oldPod, ObjectNew: newPod})).To(BeTrue())
+	})
+})
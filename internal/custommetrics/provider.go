@@ -0,0 +1,258 @@
+package custommetrics
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+
+	"github.com/itspeetah/neptune-depdag-controller/aggregator"
+)
+
+// Names under which the times of a function are served
+const (
+	// ExternalResponseTimeMetric is the time the function spends waiting on the functions it invokes
+	ExternalResponseTimeMetric = "external_response_time"
+	// EndToEndResponseTimeMetric is the response time of the function including the functions it invokes
+	EndToEndResponseTimeMetric = "end_to_end_response_time"
+	// RawExternalResponseTimeMetric and RawEndToEndResponseTimeMetric are computed from the latest measurements only,
+	// when the graph smooths the response times
+	RawExternalResponseTimeMetric = "raw_external_response_time"
+	RawEndToEndResponseTimeMetric = "raw_end_to_end_response_time"
+	// ExpectedRequestRateMetric is the requests per second the function should receive given the load of its graph
+	ExpectedRequestRateMetric = "expected_request_rate"
+	// ResponseTimeTargetMetric is the share of the response time SLOs of the graph the function should meet,
+	// only served for the functions the SLOs depend on
+	ResponseTimeTargetMetric = "response_time_target"
+)
+
+var servedMetrics = []string{
+	ExternalResponseTimeMetric, EndToEndResponseTimeMetric,
+	RawExternalResponseTimeMetric, RawEndToEndResponseTimeMetric,
+	ExpectedRequestRateMetric, ResponseTimeTargetMetric,
+}
+
+var (
+	servicesResource = schema.GroupResource{Resource: "services"}
+	podsResource     = schema.GroupResource{Resource: "pods"}
+)
+
+type functionValue struct {
+	// values are indexed by metric name
+	values    map[string]float64
+	timestamp time.Time
+	pods      []string
+}
+
+// Provider serves the latest times computed for each function through the custom metrics API,
+// both on the Service exposing the function and on each of its pods.
+type Provider struct {
+	client client.Reader
+
+	lock sync.RWMutex
+	// graph -> function namespace/name -> value
+	values map[types.NamespacedName]map[types.NamespacedName]functionValue
+}
+
+var _ provider.CustomMetricsProvider = &Provider{}
+var _ aggregator.Publisher = &Provider{}
+
+// NewProvider creates an empty provider, client is used to resolve label selectors in wildcard requests.
+func NewProvider(client client.Reader) *Provider {
+	return &Provider{
+		client: client,
+		values: make(map[types.NamespacedName]map[types.NamespacedName]functionValue),
+	}
+}
+
+// Publish replaces the values served for the graph of the result.
+func (p *Provider) Publish(ctx context.Context, result *aggregator.Result) error {
+	if result.TimedOut {
+		// Keep serving the times of the last complete cycle
+		return nil
+	}
+
+	graphValues := make(map[types.NamespacedName]functionValue, len(result.Functions))
+	for _, function := range result.Functions {
+		values := map[string]float64{
+			ExternalResponseTimeMetric: function.ExternalResponseTime,
+			EndToEndResponseTimeMetric: function.EndToEndResponseTime,
+
+			RawExternalResponseTimeMetric: function.Raw.ExternalResponseTime,
+			RawEndToEndResponseTimeMetric: function.Raw.EndToEndResponseTime,
+		}
+		if function.RequestRateKnown {
+			values[ExpectedRequestRateMetric] = function.ExpectedRequestRate
+		}
+		if function.Budget != nil {
+			values[ResponseTimeTargetMetric] = function.Budget.ResponseTime
+		}
+		graphValues[types.NamespacedName{Namespace: function.Namespace, Name: function.Name}] = functionValue{
+			values:    values,
+			timestamp: result.Timestamp,
+			pods:      function.Pods,
+		}
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.values[result.Graph] = graphValues
+	return nil
+}
+
+// Retract stops serving the values of the graph.
+func (p *Provider) Retract(ctx context.Context, graph types.NamespacedName) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.values, graph)
+	return nil
+}
+
+// lookup returns the most recent value published for the function by any graph
+func (p *Provider) lookup(function types.NamespacedName) (functionValue, bool) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	var latest functionValue
+	found := false
+	for _, graphValues := range p.values {
+		if value, ok := graphValues[function]; ok && (!found || value.timestamp.After(latest.timestamp)) {
+			latest = value
+			found = true
+		}
+	}
+	return latest, found
+}
+
+// lookupPod returns the most recent value published for the function served by the pod
+func (p *Provider) lookupPod(pod types.NamespacedName) (functionValue, bool) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	var latest functionValue
+	found := false
+	for _, graphValues := range p.values {
+		for function, value := range graphValues {
+			if function.Namespace != pod.Namespace || (found && !value.timestamp.After(latest.timestamp)) {
+				continue
+			}
+			for _, podName := range value.pods {
+				if podName == pod.Name {
+					latest = value
+					found = true
+					break
+				}
+			}
+		}
+	}
+	return latest, found
+}
+
+func (p *Provider) GetMetricByName(ctx context.Context, name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
+	if !slices.Contains(servedMetrics, info.Metric) {
+		return nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
+	}
+
+	var value functionValue
+	var found bool
+	var kind string
+	switch info.GroupResource {
+	case servicesResource:
+		value, found = p.lookup(name)
+		kind = "Service"
+	case podsResource:
+		value, found = p.lookupPod(name)
+		kind = "Pod"
+	default:
+		return nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
+	}
+	if _, ok := value.values[info.Metric]; !found || !ok {
+		return nil, provider.NewMetricNotFoundForError(info.GroupResource, info.Metric, name.Name)
+	}
+
+	return metricValue(kind, name, info.Metric, value), nil
+}
+
+func (p *Provider) GetMetricBySelector(ctx context.Context, namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+	if !slices.Contains(servedMetrics, info.Metric) {
+		return nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
+	}
+
+	var names []string
+	var kind string
+	switch info.GroupResource {
+	case servicesResource:
+		serviceList := &corev1.ServiceList{}
+		if err := p.client.List(ctx, serviceList, client.InNamespace(namespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+			return nil, err
+		}
+		for _, service := range serviceList.Items {
+			names = append(names, service.Name)
+		}
+		kind = "Service"
+	case podsResource:
+		podList := &corev1.PodList{}
+		if err := p.client.List(ctx, podList, client.InNamespace(namespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+			return nil, err
+		}
+		for _, pod := range podList.Items {
+			names = append(names, pod.Name)
+		}
+		kind = "Pod"
+	default:
+		return nil, provider.NewMetricNotFoundError(info.GroupResource, info.Metric)
+	}
+
+	list := &custom_metrics.MetricValueList{}
+	for _, objectName := range names {
+		name := types.NamespacedName{Namespace: namespace, Name: objectName}
+		var value functionValue
+		var found bool
+		if kind == "Service" {
+			value, found = p.lookup(name)
+		} else {
+			value, found = p.lookupPod(name)
+		}
+		// Objects that are not part of any graph (or without this metric) simply have no value
+		if _, ok := value.values[info.Metric]; found && ok {
+			list.Items = append(list.Items, *metricValue(kind, name, info.Metric, value))
+		}
+	}
+	return list, nil
+}
+
+func (p *Provider) ListAllMetrics() []provider.CustomMetricInfo {
+	infos := []provider.CustomMetricInfo{}
+	for _, metric := range servedMetrics {
+		infos = append(infos,
+			provider.CustomMetricInfo{GroupResource: servicesResource, Namespaced: true, Metric: metric},
+			provider.CustomMetricInfo{GroupResource: podsResource, Namespaced: true, Metric: metric},
+		)
+	}
+	return infos
+}
+
+func metricValue(kind string, name types.NamespacedName, metric string, value functionValue) *custom_metrics.MetricValue {
+	return &custom_metrics.MetricValue{
+		DescribedObject: custom_metrics.ObjectReference{
+			APIVersion: "v1",
+			Kind:       kind,
+			Namespace:  name.Namespace,
+			Name:       name.Name,
+		},
+		Metric:    custom_metrics.MetricIdentifier{Name: metric},
+		Timestamp: metav1.NewTime(value.timestamp),
+		// Seconds (or requests per second) with millisecond precision (e.g. 150m is 150ms)
+		Value: *resource.NewMilliQuantity(int64(value.values[metric]*1000), resource.DecimalSI),
+	}
+}
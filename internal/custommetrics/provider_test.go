@@ -0,0 +1,146 @@
+package custommetrics
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/custom-metrics-apiserver/pkg/provider"
+
+	"github.com/itspeetah/neptune-depdag-controller/aggregator"
+)
+
+var _ = Describe("Provider", func() {
+	ctx := context.Background()
+	graph := types.NamespacedName{Namespace: "default", Name: "graph"}
+	serviceInfo := provider.CustomMetricInfo{GroupResource: servicesResource, Namespaced: true, Metric: ExternalResponseTimeMetric}
+	podInfo := provider.CustomMetricInfo{GroupResource: podsResource, Namespaced: true, Metric: ExternalResponseTimeMetric}
+
+	var p *Provider
+
+	BeforeEach(func() {
+		client := fake.NewClientBuilder().WithObjects(
+			&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "fn", Name: "frontend-1", Labels: map[string]string{"app": "frontend"}}},
+			&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "fn", Name: "frontend-2", Labels: map[string]string{"app": "frontend"}}},
+			&corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "fn", Name: "frontend", Labels: map[string]string{"tier": "web"}}},
+		).Build()
+		p = NewProvider(client)
+
+		Expect(p.Publish(ctx, &aggregator.Result{
+			Graph:     graph,
+			Timestamp: time.Now(),
+			Functions: map[string]aggregator.FunctionTimes{
+				"frontend": {Name: "frontend", Namespace: "fn", Pods: []string{"frontend-1"}, ResponseTime: 0.1, ExternalResponseTime: 0.25, EndToEndResponseTime: 0.35,
+					Raw: aggregator.RawTimes{ResponseTime: 0.2, ExternalResponseTime: 0.3, EndToEndResponseTime: 0.5}, ExpectedRequestRate: 4, RequestRateKnown: true,
+					Budget: &aggregator.Budget{EndToEnd: 0.3, ResponseTime: 0.08}},
+				"database": {Name: "database", Namespace: "fn", ResponseTime: 0.05},
+			},
+		})).To(Succeed())
+	})
+
+	It("should serve the external response time of a function on its service", func() {
+		value, err := p.GetMetricByName(ctx, types.NamespacedName{Namespace: "fn", Name: "frontend"}, serviceInfo, labels.Everything())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value.DescribedObject.Kind).To(Equal("Service"))
+		Expect(value.Value.MilliValue()).To(Equal(int64(250)))
+	})
+
+	It("should serve the end-to-end response time of a function", func() {
+		info := provider.CustomMetricInfo{GroupResource: servicesResource, Namespaced: true, Metric: EndToEndResponseTimeMetric}
+		value, err := p.GetMetricByName(ctx, types.NamespacedName{Namespace: "fn", Name: "frontend"}, info, labels.Everything())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value.Metric.Name).To(Equal(EndToEndResponseTimeMetric))
+		Expect(value.Value.MilliValue()).To(Equal(int64(350)))
+	})
+
+	It("should serve the times computed from the raw measurements", func() {
+		info := provider.CustomMetricInfo{GroupResource: servicesResource, Namespaced: true, Metric: RawEndToEndResponseTimeMetric}
+		value, err := p.GetMetricByName(ctx, types.NamespacedName{Namespace: "fn", Name: "frontend"}, info, labels.Everything())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value.Value.MilliValue()).To(Equal(int64(500)))
+	})
+
+	It("should serve the expected request rate of a function", func() {
+		info := provider.CustomMetricInfo{GroupResource: podsResource, Namespaced: true, Metric: ExpectedRequestRateMetric}
+		value, err := p.GetMetricByName(ctx, types.NamespacedName{Namespace: "fn", Name: "frontend-1"}, info, labels.Everything())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value.Value.MilliValue()).To(Equal(int64(4000)))
+
+		// The request rate of the database is unknown, not 0
+		_, err = p.GetMetricByName(ctx, types.NamespacedName{Namespace: "fn", Name: "database"},
+			provider.CustomMetricInfo{GroupResource: servicesResource, Namespaced: true, Metric: ExpectedRequestRateMetric}, labels.Everything())
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("should serve the response time target only of the functions under an SLO", func() {
+		info := provider.CustomMetricInfo{GroupResource: servicesResource, Namespaced: true, Metric: ResponseTimeTargetMetric}
+		value, err := p.GetMetricByName(ctx, types.NamespacedName{Namespace: "fn", Name: "frontend"}, info, labels.Everything())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value.Value.MilliValue()).To(Equal(int64(80)))
+
+		_, err = p.GetMetricByName(ctx, types.NamespacedName{Namespace: "fn", Name: "database"}, info, labels.Everything())
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("should serve the external response time of a function on its pods", func() {
+		value, err := p.GetMetricByName(ctx, types.NamespacedName{Namespace: "fn", Name: "frontend-1"}, podInfo, labels.Everything())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value.DescribedObject.Kind).To(Equal("Pod"))
+		Expect(value.Value.MilliValue()).To(Equal(int64(250)))
+
+		_, err = p.GetMetricByName(ctx, types.NamespacedName{Namespace: "fn", Name: "frontend-2"}, podInfo, labels.Everything())
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("should only return values for objects tracked by a graph when selecting by labels", func() {
+		list, err := p.GetMetricBySelector(ctx, "fn", labels.SelectorFromSet(labels.Set{"app": "frontend"}), podInfo, labels.Everything())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(list.Items).To(HaveLen(1))
+		Expect(list.Items[0].DescribedObject.Name).To(Equal("frontend-1"))
+
+		list, err = p.GetMetricBySelector(ctx, "fn", labels.Everything(), serviceInfo, labels.Everything())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(list.Items).To(HaveLen(1))
+		Expect(list.Items[0].DescribedObject.Name).To(Equal("frontend"))
+	})
+
+	It("should not serve unknown metrics or functions", func() {
+		_, err := p.GetMetricByName(ctx, types.NamespacedName{Namespace: "fn", Name: "frontend"},
+			provider.CustomMetricInfo{GroupResource: servicesResource, Namespaced: true, Metric: "other"}, labels.Everything())
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+
+		_, err = p.GetMetricByName(ctx, types.NamespacedName{Namespace: "other", Name: "frontend"}, serviceInfo, labels.Everything())
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("should replace the values of a graph when it publishes again", func() {
+		Expect(p.Publish(ctx, &aggregator.Result{
+			Graph:     graph,
+			Timestamp: time.Now(),
+			Functions: map[string]aggregator.FunctionTimes{
+				"frontend": {Name: "frontend", Namespace: "fn", ExternalResponseTime: 0.5},
+			},
+		})).To(Succeed())
+
+		value, err := p.GetMetricByName(ctx, types.NamespacedName{Namespace: "fn", Name: "frontend"}, serviceInfo, labels.Everything())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(value.Value.MilliValue()).To(Equal(int64(500)))
+
+		_, err = p.GetMetricByName(ctx, types.NamespacedName{Namespace: "fn", Name: "database"}, serviceInfo, labels.Everything())
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("should stop serving the values of a graph when it is retracted", func() {
+		Expect(p.Retract(ctx, graph)).To(Succeed())
+
+		_, err := p.GetMetricByName(ctx, types.NamespacedName{Namespace: "fn", Name: "frontend"}, serviceInfo, labels.Everything())
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+})
@@ -0,0 +1,60 @@
+package custommetrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/spf13/pflag"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+	basecmd "sigs.k8s.io/custom-metrics-apiserver/pkg/cmd"
+)
+
+// Adapter is the custom.metrics.k8s.io API server, run by the manager.
+// It runs on every replica, but only the leader aggregates the graphs: the others would report the metrics as not
+// found, so they are kept out of the endpoints of the service by the readiness check of ElectedCheck.
+type Adapter struct {
+	*basecmd.AdapterBase
+}
+
+// NewAdapter builds the custom.metrics.k8s.io API server serving the values of the provider on the given port.
+// The server relies on the in-cluster configuration for delegated authentication and authorization.
+func NewAdapter(p *Provider, port int, certDir string) *Adapter {
+	adapter := &basecmd.AdapterBase{
+		Name: "depdag-custom-metrics",
+		// The adapter flags are not exposed by the manager, options are set below instead
+		FlagSet: pflag.NewFlagSet("custom-metrics", pflag.ContinueOnError),
+	}
+	adapter.InstallFlags()
+
+	adapter.SecureServing.BindPort = port
+	if certDir != "" {
+		adapter.SecureServing.ServerCert.CertDirectory = certDir
+	}
+	adapter.WithCustomMetrics(p)
+
+	return &Adapter{AdapterBase: adapter}
+}
+
+// Start runs the server until the context is done
+func (a *Adapter) Start(ctx context.Context) error {
+	return a.Run(ctx)
+}
+
+// NeedLeaderElection is false, so that the server is also started on the replicas that are not leading
+func (a *Adapter) NeedLeaderElection() bool {
+	return false
+}
+
+// ElectedCheck is a readiness check failing until elected is closed, i.e. until the replica leads and has the times
+// of the graphs, so that the requests to the APIService only reach the leader
+func ElectedCheck(elected <-chan struct{}) healthz.Checker {
+	return func(_ *http.Request) error {
+		select {
+		case <-elected:
+			return nil
+		default:
+			return errors.New("not leading, the graph metrics are served by the leader")
+		}
+	}
+}
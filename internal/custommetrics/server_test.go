@@ -0,0 +1,28 @@
+package custommetrics
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+var _ = Describe("Adapter", func() {
+	It("should run on every replica of the manager, not only on the leader", func() {
+		var runnable manager.Runnable = NewAdapter(NewProvider(fake.NewClientBuilder().Build()), 6443, "")
+		leaderElectionRunnable, ok := runnable.(manager.LeaderElectionRunnable)
+		Expect(ok).To(BeTrue())
+		Expect(leaderElectionRunnable.NeedLeaderElection()).To(BeFalse())
+	})
+})
+
+var _ = Describe("ElectedCheck", func() {
+	It("should only be ready once the replica is elected", func() {
+		elected := make(chan struct{})
+		check := ElectedCheck(elected)
+		Expect(check(nil)).NotTo(Succeed())
+
+		close(elected)
+		Expect(check(nil)).To(Succeed())
+	})
+})
@@ -0,0 +1,258 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/itspeetah/neptune-depdag-controller/aggregator"
+	provisioningv1alpha1 "github.com/itspeetah/neptune-depdag-controller/api/v1alpha1"
+)
+
+// nolint:unused
+// log is for logging in this package.
+var dependencygraphlog = logf.Log.WithName("dependencygraph-resource")
+
+// SetupDependencyGraphWebhookWithManager registers the webhook for DependencyGraph in the manager.
+func SetupDependencyGraphWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).For(&provisioningv1alpha1.DependencyGraph{}).
+		WithValidator(&DependencyGraphCustomValidator{}).
+		Complete()
+}
+
+// +kubebuilder:webhook:path=/validate-provisioning-pgmp-me-v1alpha1-dependencygraph,mutating=false,failurePolicy=fail,sideEffects=None,groups=provisioning.pgmp.me,resources=dependencygraphs,verbs=create;update,versions=v1alpha1,name=vdependencygraph-v1alpha1.kb.io,admissionReviewVersions=v1
+
+// DependencyGraphCustomValidator struct is responsible for validating the DependencyGraph resource
+// when it is created or updated.
+type DependencyGraphCustomValidator struct{}
+
+var _ webhook.CustomValidator = &DependencyGraphCustomValidator{}
+
+// ValidateCreate implements webhook.CustomValidator so a webhook will be registered for the type DependencyGraph.
+func (v *DependencyGraphCustomValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	dependencygraph, ok := obj.(*provisioningv1alpha1.DependencyGraph)
+	if !ok {
+		return nil, fmt.Errorf("expected a DependencyGraph object but got %T", obj)
+	}
+	dependencygraphlog.Info("Validation for DependencyGraph upon creation", "name", dependencygraph.GetName())
+
+	return dependencyGraphWarnings(dependencygraph), validateDependencyGraph(dependencygraph)
+}
+
+// ValidateUpdate implements webhook.CustomValidator so a webhook will be registered for the type DependencyGraph.
+func (v *DependencyGraphCustomValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	dependencygraph, ok := newObj.(*provisioningv1alpha1.DependencyGraph)
+	if !ok {
+		return nil, fmt.Errorf("expected a DependencyGraph object for the newObj but got %T", newObj)
+	}
+	oldDependencygraph, ok := oldObj.(*provisioningv1alpha1.DependencyGraph)
+	if !ok {
+		return nil, fmt.Errorf("expected a DependencyGraph object for the oldObj but got %T", oldObj)
+	}
+	dependencygraphlog.Info("Validation for DependencyGraph upon update", "name", dependencygraph.GetName())
+
+	// Graphs stored before a rule existed must still be able to get and lose their finalizer
+	if !dependencygraph.DeletionTimestamp.IsZero() ||
+		(equality.Semantic.DeepEqual(oldDependencygraph.Spec, dependencygraph.Spec) &&
+			oldDependencygraph.Annotations[provisioningv1alpha1.EdgeGroupScopeAnnotation] ==
+				dependencygraph.Annotations[provisioningv1alpha1.EdgeGroupScopeAnnotation]) {
+		return dependencyGraphWarnings(dependencygraph), nil
+	}
+
+	return dependencyGraphWarnings(dependencygraph), validateDependencyGraph(dependencygraph)
+}
+
+// ValidateDelete implements webhook.CustomValidator so a webhook will be registered for the type DependencyGraph.
+func (v *DependencyGraphCustomValidator) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	// Nothing to validate on deletion
+	return nil, nil
+}
+
+// dependencyGraphWarnings returns the deprecations in use by the graph
+func dependencyGraphWarnings(dependencygraph *provisioningv1alpha1.DependencyGraph) admission.Warnings {
+	var warnings admission.Warnings
+	if dependencygraph.Annotations[provisioningv1alpha1.EdgeGroupScopeAnnotation] == provisioningv1alpha1.EdgeGroupScopeGraph {
+		warnings = append(warnings, fmt.Sprintf(
+			"%s=%s is deprecated: edges with the same id are aggregated across the whole graph instead of per calling node",
+			provisioningv1alpha1.EdgeGroupScopeAnnotation, provisioningv1alpha1.EdgeGroupScopeGraph))
+	}
+	return warnings
+}
+
+func validateDependencyGraph(dependencygraph *provisioningv1alpha1.DependencyGraph) error {
+	allErrs := validateDependencyGraphSpec(&dependencygraph.Spec, field.NewPath("spec"))
+	if scope, ok := dependencygraph.Annotations[provisioningv1alpha1.EdgeGroupScopeAnnotation]; ok &&
+		scope != provisioningv1alpha1.EdgeGroupScopeNode && scope != provisioningv1alpha1.EdgeGroupScopeGraph {
+		allErrs = append(allErrs, field.NotSupported(
+			field.NewPath("metadata", "annotations").Key(provisioningv1alpha1.EdgeGroupScopeAnnotation), scope,
+			[]string{provisioningv1alpha1.EdgeGroupScopeNode, provisioningv1alpha1.EdgeGroupScopeGraph}))
+	}
+	if len(allErrs) == 0 {
+		return nil
+	}
+
+	return apierrors.NewInvalid(
+		provisioningv1alpha1.GroupVersion.WithKind("DependencyGraph").GroupKind(),
+		dependencygraph.Name, allErrs)
+}
+
+func validateDependencyGraphSpec(spec *provisioningv1alpha1.DependencyGraphSpec, specPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	nodesPath := specPath.Child("nodes")
+
+	if spec.AggregationInterval != nil && spec.AggregationInterval.Duration < provisioningv1alpha1.MinAggregationInterval {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("aggregationInterval"), spec.AggregationInterval.Duration.String(),
+			fmt.Sprintf("must be at least %s", provisioningv1alpha1.MinAggregationInterval)))
+	}
+
+	if spec.Percentile < 0 || spec.Percentile > 99 {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("percentile"), spec.Percentile, "must be between 1 and 99"))
+	}
+
+	if spec.Smoothing != nil {
+		allErrs = append(allErrs, validateSmoothing(spec.Smoothing, specPath.Child("smoothing"))...)
+		if spec.Percentile > 0 && spec.Smoothing.Method != "" && spec.Smoothing.Method != provisioningv1alpha1.SmoothingNone {
+			allErrs = append(allErrs, field.Forbidden(specPath.Child("smoothing", "method"), "percentiles cannot be smoothed"))
+		}
+	}
+
+	if spec.FunctionNamespace != "" {
+		for _, msg := range validation.IsDNS1123Label(spec.FunctionNamespace) {
+			allErrs = append(allErrs, field.Invalid(specPath.Child("functionNamespace"), spec.FunctionNamespace, msg))
+		}
+	}
+
+	declared := make(map[string]bool, len(spec.Nodes))
+	for i, node := range spec.Nodes {
+		namePath := nodesPath.Index(i).Child("functionName")
+		if node.FunctionName == "" {
+			allErrs = append(allErrs, field.Required(namePath, "every node must have a function name"))
+			continue
+		}
+		if declared[node.FunctionName] {
+			allErrs = append(allErrs, field.Duplicate(namePath, node.FunctionName))
+			continue
+		}
+		declared[node.FunctionName] = true
+
+		if node.Namespace != "" {
+			for _, msg := range validation.IsDNS1123Label(node.Namespace) {
+				allErrs = append(allErrs, field.Invalid(nodesPath.Index(i).Child("namespace"), node.Namespace, msg))
+			}
+		}
+	}
+
+	invokedSync := make(map[string]bool, len(spec.Nodes))
+	for i, node := range spec.Nodes {
+		for j, edge := range node.Invocations {
+			edgePath := nodesPath.Index(i).Child("invocations").Index(j)
+			if edge.IsSync() {
+				invokedSync[edge.FunctionName] = true
+			}
+			if !declared[edge.FunctionName] {
+				allErrs = append(allErrs, field.NotFound(edgePath.Child("functionName"), edge.FunctionName))
+			}
+			if edge.EdgeMultiplier <= 0 {
+				allErrs = append(allErrs, field.Invalid(edgePath.Child("edgeMultiplier"), edge.EdgeMultiplier, "must be greater than 0"))
+			}
+			if edge.Probability != nil && (edge.Probability.Sign() < 0 || edge.Probability.Cmp(resource.MustParse("1")) > 0) {
+				allErrs = append(allErrs, field.Invalid(edgePath.Child("probability"), edge.Probability.String(), "must be between 0 and 1"))
+			}
+			switch edge.Kind {
+			case "", provisioningv1alpha1.EdgeKindSync, provisioningv1alpha1.EdgeKindAsync, provisioningv1alpha1.EdgeKindStream:
+			default:
+				allErrs = append(allErrs, field.NotSupported(edgePath.Child("kind"), edge.Kind, []string{
+					string(provisioningv1alpha1.EdgeKindSync), string(provisioningv1alpha1.EdgeKindAsync), string(provisioningv1alpha1.EdgeKindStream),
+				}))
+			}
+			allErrs = append(allErrs, validateEdgeRetries(edge, edgePath)...)
+		}
+	}
+
+	for i, node := range spec.Nodes {
+		if node.ResponseTimeSLO == nil {
+			continue
+		}
+		sloPath := nodesPath.Index(i).Child("responseTimeSLO")
+		if node.ResponseTimeSLO.Duration <= 0 {
+			allErrs = append(allErrs, field.Invalid(sloPath, node.ResponseTimeSLO.Duration.String(), "must be greater than 0"))
+		}
+		if invokedSync[node.FunctionName] {
+			allErrs = append(allErrs, field.Forbidden(sloPath,
+				"only functions that no other function invokes synchronously can have a response time SLO"))
+		}
+	}
+
+	if cycle := aggregator.FindCycle(spec.Nodes); len(cycle) > 0 {
+		allErrs = append(allErrs, field.Invalid(nodesPath, strings.Join(cycle, " -> "),
+			"invocations must not form a cycle"))
+	}
+
+	return allErrs
+}
+
+func validateEdgeRetries(edge provisioningv1alpha1.InvocationEdge, edgePath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if edge.Timeout != nil && edge.Timeout.Duration <= 0 {
+		allErrs = append(allErrs, field.Invalid(edgePath.Child("timeout"), edge.Timeout.Duration.String(), "must be greater than 0"))
+	}
+	if edge.ErrorRate != nil && (edge.ErrorRate.Sign() < 0 || edge.ErrorRate.Cmp(resource.MustParse("1")) > 0) {
+		allErrs = append(allErrs, field.Invalid(edgePath.Child("errorRate"), edge.ErrorRate.String(), "must be between 0 and 1"))
+	}
+	if edge.Retries < 0 || edge.Retries > provisioningv1alpha1.MaxEdgeRetries {
+		allErrs = append(allErrs, field.Invalid(edgePath.Child("retries"), edge.Retries,
+			fmt.Sprintf("must be between 0 and %d", provisioningv1alpha1.MaxEdgeRetries)))
+	}
+	if edge.RetryBackoff != nil && edge.RetryBackoff.Duration < 0 {
+		allErrs = append(allErrs, field.Invalid(edgePath.Child("retryBackoff"), edge.RetryBackoff.Duration.String(), "must not be negative"))
+	}
+	return allErrs
+}
+
+func validateSmoothing(smoothing *provisioningv1alpha1.Smoothing, smoothingPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	switch smoothing.Method {
+	case "", provisioningv1alpha1.SmoothingNone, provisioningv1alpha1.SmoothingEWMA,
+		provisioningv1alpha1.SmoothingWindowMean, provisioningv1alpha1.SmoothingWindowMedian:
+	default:
+		allErrs = append(allErrs, field.NotSupported(smoothingPath.Child("method"), smoothing.Method, []string{
+			string(provisioningv1alpha1.SmoothingNone), string(provisioningv1alpha1.SmoothingEWMA),
+			string(provisioningv1alpha1.SmoothingWindowMean), string(provisioningv1alpha1.SmoothingWindowMedian),
+		}))
+	}
+	if smoothing.WeightPercent < 0 || smoothing.WeightPercent > 100 {
+		allErrs = append(allErrs, field.Invalid(smoothingPath.Child("weightPercent"), smoothing.WeightPercent, "must be between 1 and 100"))
+	}
+	if smoothing.Window < 0 || smoothing.Window > provisioningv1alpha1.MaxSmoothingWindow {
+		allErrs = append(allErrs, field.Invalid(smoothingPath.Child("window"), smoothing.Window,
+			fmt.Sprintf("must be between 1 and %d", provisioningv1alpha1.MaxSmoothingWindow)))
+	}
+	return allErrs
+}
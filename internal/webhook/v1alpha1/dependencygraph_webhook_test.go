@@ -0,0 +1,264 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	provisioningv1alpha1 "github.com/itspeetah/neptune-depdag-controller/api/v1alpha1"
+)
+
+var _ = Describe("DependencyGraph Webhook", func() {
+	var (
+		ctx       context.Context
+		obj       *provisioningv1alpha1.DependencyGraph
+		oldObj    *provisioningv1alpha1.DependencyGraph
+		validator DependencyGraphCustomValidator
+	)
+
+	// causes returns the field path and type of every cause of an Invalid error
+	causes := func(err error) []string {
+		statusErr, ok := err.(*apierrors.StatusError)
+		Expect(ok).To(BeTrue())
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		fields := []string{}
+		for _, cause := range statusErr.ErrStatus.Details.Causes {
+			fields = append(fields, cause.Field+" "+string(cause.Type))
+		}
+		return fields
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		obj = &provisioningv1alpha1.DependencyGraph{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-graph", Namespace: "default"},
+			Spec: provisioningv1alpha1.DependencyGraphSpec{
+				Nodes: []provisioningv1alpha1.FunctionNode{
+					{FunctionName: "A", Invocations: []provisioningv1alpha1.InvocationEdge{
+						{FunctionName: "B", EdgeId: 1, EdgeMultiplier: 1},
+						{FunctionName: "C", EdgeId: 1, EdgeMultiplier: 2},
+					}},
+					{FunctionName: "B", Invocations: []provisioningv1alpha1.InvocationEdge{
+						{FunctionName: "C", EdgeId: 1, EdgeMultiplier: 1},
+					}},
+					{FunctionName: "C", Invocations: []provisioningv1alpha1.InvocationEdge{}},
+				},
+			},
+		}
+		oldObj = obj.DeepCopy()
+		validator = DependencyGraphCustomValidator{}
+	})
+
+	Context("When creating or updating DependencyGraph under Validating Webhook", func() {
+		It("Should admit a valid DAG", func() {
+			Expect(validator.ValidateCreate(ctx, obj)).To(BeNil())
+			Expect(validator.ValidateUpdate(ctx, oldObj, obj)).To(BeNil())
+		})
+
+		It("Should deny duplicate function names", func() {
+			obj.Spec.Nodes = append(obj.Spec.Nodes, provisioningv1alpha1.FunctionNode{FunctionName: "B"})
+			_, err := validator.ValidateCreate(ctx, obj)
+			Expect(causes(err)).To(ConsistOf("spec.nodes[3].functionName FieldValueDuplicate"))
+		})
+
+		It("Should deny edges to undeclared nodes", func() {
+			obj.Spec.Nodes[1].Invocations = append(obj.Spec.Nodes[1].Invocations,
+				provisioningv1alpha1.InvocationEdge{FunctionName: "D", EdgeId: 2, EdgeMultiplier: 1})
+			_, err := validator.ValidateUpdate(ctx, oldObj, obj)
+			Expect(causes(err)).To(ConsistOf("spec.nodes[1].invocations[1].functionName FieldValueNotFound"))
+		})
+
+		It("Should deny edge probabilities outside of [0, 1]", func() {
+			valid, tooHigh, negative := resource.MustParse("0.25"), resource.MustParse("1.5"), resource.MustParse("-0.1")
+			obj.Spec.Nodes[0].Invocations[0].Probability = &valid
+			Expect(validator.ValidateCreate(ctx, obj)).To(BeNil())
+
+			obj.Spec.Nodes[0].Invocations[0].Probability = &tooHigh
+			obj.Spec.Nodes[0].Invocations[1].Probability = &negative
+			_, err := validator.ValidateCreate(ctx, obj)
+			Expect(causes(err)).To(ConsistOf(
+				"spec.nodes[0].invocations[0].probability FieldValueInvalid",
+				"spec.nodes[0].invocations[1].probability FieldValueInvalid",
+			))
+		})
+
+		It("Should deny unknown edge kinds", func() {
+			obj.Spec.Nodes[0].Invocations[0].Kind = provisioningv1alpha1.EdgeKindAsync
+			Expect(validator.ValidateCreate(ctx, obj)).To(BeNil())
+
+			obj.Spec.Nodes[0].Invocations[1].Kind = "Webhook"
+			_, err := validator.ValidateCreate(ctx, obj)
+			Expect(causes(err)).To(ConsistOf("spec.nodes[0].invocations[1].kind FieldValueNotSupported"))
+		})
+
+		It("Should deny invalid retries and timeouts", func() {
+			errorRate := resource.MustParse("0.05")
+			obj.Spec.Nodes[0].Invocations[0].Timeout = &metav1.Duration{Duration: time.Second}
+			obj.Spec.Nodes[0].Invocations[0].ErrorRate = &errorRate
+			obj.Spec.Nodes[0].Invocations[0].Retries = 3
+			obj.Spec.Nodes[0].Invocations[0].RetryBackoff = &metav1.Duration{Duration: 50 * time.Millisecond}
+			Expect(validator.ValidateCreate(ctx, obj)).To(BeNil())
+
+			tooHigh := resource.MustParse("2")
+			obj.Spec.Nodes[0].Invocations[1].Timeout = &metav1.Duration{}
+			obj.Spec.Nodes[0].Invocations[1].ErrorRate = &tooHigh
+			obj.Spec.Nodes[0].Invocations[1].Retries = provisioningv1alpha1.MaxEdgeRetries + 1
+			obj.Spec.Nodes[0].Invocations[1].RetryBackoff = &metav1.Duration{Duration: -time.Second}
+			_, err := validator.ValidateCreate(ctx, obj)
+			Expect(causes(err)).To(ConsistOf(
+				"spec.nodes[0].invocations[1].timeout FieldValueInvalid",
+				"spec.nodes[0].invocations[1].errorRate FieldValueInvalid",
+				"spec.nodes[0].invocations[1].retries FieldValueInvalid",
+				"spec.nodes[0].invocations[1].retryBackoff FieldValueInvalid",
+			))
+		})
+
+		It("Should deny invalid response time SLOs and SLOs on invoked functions", func() {
+			obj.Spec.Nodes[0].ResponseTimeSLO = &metav1.Duration{Duration: time.Second}
+			Expect(validator.ValidateCreate(ctx, obj)).To(BeNil())
+
+			obj.Spec.Nodes[0].ResponseTimeSLO = &metav1.Duration{}
+			obj.Spec.Nodes[2].ResponseTimeSLO = &metav1.Duration{Duration: time.Second}
+			_, err := validator.ValidateCreate(ctx, obj)
+			Expect(causes(err)).To(ConsistOf(
+				"spec.nodes[0].responseTimeSLO FieldValueInvalid",
+				"spec.nodes[2].responseTimeSLO FieldValueForbidden",
+			))
+
+			// Functions only invoked asynchronously are entry functions of their own
+			obj.Spec.Nodes[0].ResponseTimeSLO = nil
+			obj.Spec.Nodes[0].Invocations[1].Kind = provisioningv1alpha1.EdgeKindAsync
+			obj.Spec.Nodes[1].Invocations[0].Kind = provisioningv1alpha1.EdgeKindStream
+			Expect(validator.ValidateCreate(ctx, obj)).To(BeNil())
+		})
+
+		It("Should deny non-positive edge multipliers", func() {
+			obj.Spec.Nodes[0].Invocations[0].EdgeMultiplier = 0
+			obj.Spec.Nodes[0].Invocations[1].EdgeMultiplier = -1
+			_, err := validator.ValidateCreate(ctx, obj)
+			Expect(causes(err)).To(ConsistOf(
+				"spec.nodes[0].invocations[0].edgeMultiplier FieldValueInvalid",
+				"spec.nodes[0].invocations[1].edgeMultiplier FieldValueInvalid",
+			))
+		})
+
+		It("Should deny cycles reporting the cycle path", func() {
+			obj.Spec.Nodes[2].Invocations = append(obj.Spec.Nodes[2].Invocations,
+				provisioningv1alpha1.InvocationEdge{FunctionName: "A", EdgeId: 1, EdgeMultiplier: 1})
+			_, err := validator.ValidateCreate(ctx, obj)
+			Expect(causes(err)).To(ConsistOf("spec.nodes FieldValueInvalid"))
+			Expect(err.Error()).To(ContainSubstring("A -> B -> C -> A"))
+		})
+
+		It("Should deny self invocations", func() {
+			obj.Spec.Nodes[2].Invocations = append(obj.Spec.Nodes[2].Invocations,
+				provisioningv1alpha1.InvocationEdge{FunctionName: "C", EdgeId: 1, EdgeMultiplier: 1})
+			_, err := validator.ValidateCreate(ctx, obj)
+			Expect(err.Error()).To(ContainSubstring("C -> C"))
+		})
+
+		It("Should deny aggregation intervals shorter than the minimum", func() {
+			obj.Spec.AggregationInterval = &metav1.Duration{Duration: 30 * time.Second}
+			Expect(validator.ValidateCreate(ctx, obj)).To(BeNil())
+
+			obj.Spec.AggregationInterval = &metav1.Duration{Duration: 100 * time.Millisecond}
+			_, err := validator.ValidateCreate(ctx, obj)
+			Expect(causes(err)).To(ConsistOf("spec.aggregationInterval FieldValueInvalid"))
+		})
+
+		It("Should deny invalid smoothing", func() {
+			obj.Spec.Smoothing = &provisioningv1alpha1.Smoothing{Method: provisioningv1alpha1.SmoothingEWMA, WeightPercent: 30}
+			Expect(validator.ValidateCreate(ctx, obj)).To(BeNil())
+
+			obj.Spec.Smoothing = &provisioningv1alpha1.Smoothing{Method: "Kalman", WeightPercent: 101, Window: provisioningv1alpha1.MaxSmoothingWindow + 1}
+			_, err := validator.ValidateCreate(ctx, obj)
+			Expect(causes(err)).To(ConsistOf(
+				"spec.smoothing.method FieldValueNotSupported",
+				"spec.smoothing.weightPercent FieldValueInvalid",
+				"spec.smoothing.window FieldValueInvalid",
+			))
+		})
+
+		It("Should deny invalid percentiles and smoothed percentiles", func() {
+			obj.Spec.Percentile = 95
+			Expect(validator.ValidateCreate(ctx, obj)).To(BeNil())
+
+			obj.Spec.Percentile = 100
+			obj.Spec.Smoothing = &provisioningv1alpha1.Smoothing{Method: provisioningv1alpha1.SmoothingEWMA}
+			_, err := validator.ValidateCreate(ctx, obj)
+			Expect(causes(err)).To(ConsistOf(
+				"spec.percentile FieldValueInvalid",
+				"spec.smoothing.method FieldValueForbidden",
+			))
+		})
+
+		It("Should deny invalid function namespaces", func() {
+			obj.Spec.FunctionNamespace = "OpenFaaS_fn"
+			obj.Spec.Nodes[1].Namespace = "openfaas-fn"
+			obj.Spec.Nodes[2].Namespace = "-fn"
+			_, err := validator.ValidateCreate(ctx, obj)
+			Expect(causes(err)).To(ConsistOf(
+				"spec.functionNamespace FieldValueInvalid",
+				"spec.nodes[2].namespace FieldValueInvalid",
+			))
+		})
+
+		It("Should warn about the deprecated graph-wide edge group scope", func() {
+			obj.Annotations = map[string]string{provisioningv1alpha1.EdgeGroupScopeAnnotation: provisioningv1alpha1.EdgeGroupScopeGraph}
+			warnings, err := validator.ValidateCreate(ctx, obj)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(warnings).To(HaveLen(1))
+			Expect(warnings[0]).To(ContainSubstring("deprecated"))
+		})
+
+		It("Should deny unknown edge group scopes", func() {
+			obj.Annotations = map[string]string{provisioningv1alpha1.EdgeGroupScopeAnnotation: "cluster"}
+			_, err := validator.ValidateUpdate(ctx, oldObj, obj)
+			Expect(causes(err)).To(ConsistOf("metadata.annotations[provisioning.pgmp.me/edge-group-scope] FieldValueNotSupported"))
+		})
+
+		It("Should admit updates that leave an invalid spec unchanged, like adding or removing the finalizer", func() {
+			// A graph stored before the rules existed
+			obj.Spec.Nodes[2].Invocations = []provisioningv1alpha1.InvocationEdge{{FunctionName: "A", EdgeId: 1, EdgeMultiplier: 0}}
+			oldObj = obj.DeepCopy()
+
+			obj.Finalizers = []string{"provisioning.pgmp.me/finalizer"}
+			Expect(validator.ValidateUpdate(ctx, oldObj, obj)).To(BeNil())
+
+			obj.Spec.Nodes[0].Invocations[0].EdgeMultiplier = 3
+			_, err := validator.ValidateUpdate(ctx, oldObj, obj)
+			Expect(causes(err)).To(ConsistOf(
+				"spec.nodes[2].invocations[0].edgeMultiplier FieldValueInvalid",
+				"spec.nodes FieldValueInvalid",
+			))
+		})
+
+		It("Should admit any update of a graph being deleted", func() {
+			obj.Spec.Nodes[2].Invocations = []provisioningv1alpha1.InvocationEdge{{FunctionName: "A", EdgeId: 1, EdgeMultiplier: 1}}
+			now := metav1.Now()
+			obj.DeletionTimestamp = &now
+			Expect(validator.ValidateUpdate(ctx, oldObj, obj)).To(BeNil())
+		})
+	})
+})